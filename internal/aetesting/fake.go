@@ -10,12 +10,14 @@ import (
 	"fmt"
 	"net/http"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 
 	"google.golang.org/appengine/internal"
+	remotepb "google.golang.org/appengine/internal/remote_api"
 )
 
 // FakeSingleContext returns a context whose Call invocations will be serviced
@@ -79,3 +81,101 @@ func (s *single) call(ctx context.Context, service, method string, in, out proto
 	}
 	return outs[0].Interface().(error)
 }
+
+// FakeAPI serves the API calls made with its context, for tests of how
+// a package handles the errors the service bridge can report, or of the
+// calls it makes and their order.
+type FakeAPI struct {
+	mu        sync.Mutex
+	rpcErrors map[string]*internal.CallError // canned errors, by "service.method"
+
+	strict     bool           // whether only expected calls are answered
+	expected   []expectedCall // calls yet to be received, in order
+	unexpected []string       // "service.method" of calls received but not expected
+}
+
+type expectedCall struct {
+	service, method string
+	respond         proto.Message
+}
+
+// NewFakeAPI returns a FakeAPI that fails every call until told otherwise.
+func NewFakeAPI() *FakeAPI {
+	return &FakeAPI{}
+}
+
+// Context returns a context whose Call invocations are serviced by f.
+func (f *FakeAPI) Context() context.Context {
+	return internal.WithCallOverride(internal.ContextForTesting(&http.Request{}), f.call)
+}
+
+// RespondWithRPCError makes f answer calls to service.method with an
+// RpcError with the given code and detail, as the service bridge would.
+func (f *FakeAPI) RespondWithRPCError(service, method string, code remotepb.RpcError_ErrorCode, detail string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rpcErrors == nil {
+		f.rpcErrors = make(map[string]*internal.CallError)
+	}
+	f.rpcErrors[service+"."+method] = &internal.CallError{
+		Code:   int32(code),
+		Detail: detail,
+	}
+}
+
+// ExpectCall makes f strict: it answers only the calls it is told to
+// expect, in the order they are expected, with the given responses, which
+// must be of the type the caller decodes into. Other calls fail with
+// CALL_NOT_FOUND, and are reported by Verify.
+func (f *FakeAPI) ExpectCall(service, method string, respond proto.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.strict = true
+	f.expected = append(f.expected, expectedCall{service, method, respond})
+}
+
+// Verify reports, through t, the expected calls that f didn't receive
+// and the unexpected calls that it did.
+func (f *FakeAPI) Verify(t errorReporter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, call := range f.unexpected {
+		t.Errorf("Unexpected API call to %s", call)
+	}
+	for _, ec := range f.expected {
+		t.Errorf("Missing API call to %s.%s", ec.service, ec.method)
+	}
+}
+
+// errorReporter is the part of testing.TB used by Verify.
+type errorReporter interface {
+	Errorf(format string, args ...interface{})
+}
+
+func (f *FakeAPI) call(ctx context.Context, service, method string, in, out proto.Message) error {
+	if service == "__go__" && method == "GetNamespace" {
+		return nil // always yield an empty namespace
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ce := f.rpcErrors[service+"."+method]; ce != nil {
+		// Each call gets an error of its own, which the caller may modify.
+		e := *ce
+		return &e
+	}
+	if !f.strict {
+		return fmt.Errorf("Unknown API call /%s.%s", service, method)
+	}
+	if len(f.expected) == 0 || f.expected[0].service != service || f.expected[0].method != method {
+		f.unexpected = append(f.unexpected, service+"."+method)
+		return &internal.CallError{
+			Code:   int32(remotepb.RpcError_CALL_NOT_FOUND),
+			Detail: "unexpected call",
+		}
+	}
+	respond := f.expected[0].respond
+	f.expected = f.expected[1:]
+	out.Reset()
+	proto.Merge(out, respond)
+	return nil
+}
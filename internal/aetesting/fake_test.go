@@ -0,0 +1,78 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package aetesting
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	"google.golang.org/appengine/internal"
+	basepb "google.golang.org/appengine/internal/base"
+	remotepb "google.golang.org/appengine/internal/remote_api"
+)
+
+func TestRespondWithRPCError(t *testing.T) {
+	f := NewFakeAPI()
+	f.RespondWithRPCError("actordb", "LookupActor", remotepb.RpcError_BAD_REQUEST, "no such actor")
+	err := internal.Call(f.Context(), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	ce, ok := err.(*internal.CallError)
+	if !ok {
+		t.Fatalf("API call error is %T (%v), want *internal.CallError", err, err)
+	}
+	if ce.Code != int32(remotepb.RpcError_BAD_REQUEST) || ce.Detail != "no such actor" {
+		t.Errorf("Got error code %d detail %q, want code %d detail %q", ce.Code, ce.Detail, remotepb.RpcError_BAD_REQUEST, "no such actor")
+	}
+
+	// Other calls are unaffected.
+	err = internal.Call(f.Context(), "actordb", "LookupCompanion", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	if _, ok := err.(*internal.CallError); ok {
+		t.Errorf("Unrelated API call returned %v, want no RPC error", err)
+	}
+}
+
+// errorRecorder records the errors reported to it.
+type errorRecorder []string
+
+func (r *errorRecorder) Errorf(format string, args ...interface{}) {
+	*r = append(*r, fmt.Sprintf(format, args...))
+}
+
+func TestExpectCall(t *testing.T) {
+	f := NewFakeAPI()
+	f.ExpectCall("actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Peter Capaldi")})
+	f.ExpectCall("memcache", "Get", &basepb.VoidProto{})
+	res := &basepb.StringProto{}
+	if err := internal.Call(f.Context(), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, res); err != nil {
+		t.Fatalf("Expected call failed: %v", err)
+	}
+	if got := res.GetValue(); got != "Peter Capaldi" {
+		t.Errorf("Expected call returned %q, want the expected response %q", got, "Peter Capaldi")
+	}
+	if err := internal.Call(f.Context(), "memcache", "Get", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Fatalf("Expected call failed: %v", err)
+	}
+	f.Verify(t)
+
+	// Calls out of order, and calls not expected at all, fail.
+	f.ExpectCall("memcache", "Get", &basepb.VoidProto{})
+	f.ExpectCall("memcache", "Set", &basepb.VoidProto{})
+	err := internal.Call(f.Context(), "memcache", "Set", &basepb.VoidProto{}, &basepb.VoidProto{})
+	if ce, ok := err.(*internal.CallError); !ok || ce.Code != int32(remotepb.RpcError_CALL_NOT_FOUND) {
+		t.Errorf("Call out of order returned %v, want CALL_NOT_FOUND", err)
+	}
+	var errs errorRecorder
+	f.Verify(&errs)
+	want := []string{
+		"Unexpected API call to memcache.Set",
+		"Missing API call to memcache.Get",
+		"Missing API call to memcache.Set",
+	}
+	if !reflect.DeepEqual([]string(errs), want) {
+		t.Errorf("Verify reported %q, want %q", errs, want)
+	}
+}
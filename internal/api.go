@@ -8,19 +8,26 @@ package internal
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -54,13 +61,49 @@ var (
 	apiDeadlineHeader      = http.CanonicalHeaderKey("X-Google-RPC-Service-Deadline")
 	apiContentType         = http.CanonicalHeaderKey("Content-Type")
 	apiContentTypeValue    = []string{"application/octet-stream"}
+	apiAcceptEncoding      = http.CanonicalHeaderKey("Accept-Encoding")
+	apiAcceptEncodingValue = []string{"gzip, deflate"}
 	logFlushHeader         = http.CanonicalHeaderKey("X-AppEngine-Log-Flush-Count")
+	logTruncatedHeader     = http.CanonicalHeaderKey("X-AppEngine-Log-Truncated-Count")
 
+	// Attachments are sent and received base64-encoded in this header,
+	// since the remote_api envelope has no field for them.
+	apiAttachmentHeader = http.CanonicalHeaderKey("X-Google-RPC-Attachment")
+
+	// Calls are routed to a particular backend shard with this header,
+	// for debugging the shard.
+	apiBackendShardHeader = http.CanonicalHeaderKey("X-Google-RPC-Backend-Shard")
+
+	// Conditional calls send the caller's tag for the response it already
+	// has in this header. The bridge answers HTTP 304 if it is unchanged.
+	apiIfNoneMatchHeader = http.CanonicalHeaderKey("X-Google-RPC-If-None-Match")
+
+	// Calls carry their ID in this header, so that what the service bridge
+	// records of a call can be matched with what the app does.
+	apiCallIDHeader = http.CanonicalHeaderKey("X-Google-RPC-Call-Id")
+
+	// Incoming trailers. A bridge that fails after it has started
+	// streaming a response reports the error in these.
+	apiErrorCodeTrailer   = http.CanonicalHeaderKey("X-Google-RPC-Error-Code")
+	apiErrorDetailTrailer = http.CanonicalHeaderKey("X-Google-RPC-Error-Detail")
+
+	// API calls are made over plain HTTP with a dialer of our own, so the
+	// transports never negotiate HTTP/2: calls are always HTTP/1.1.
 	apiHTTPClient = &http.Client{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
 			Dial:  limitDial,
 		},
+		CheckRedirect: noRedirects,
+	}
+	// freshHTTPClient makes calls that mustn't use pooled connections.
+	freshHTTPClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:             http.ProxyFromEnvironment,
+			Dial:              limitDial,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: noRedirects,
 	}
 
 	defaultTicketOnce     sync.Once
@@ -69,6 +112,78 @@ var (
 	backgroundContext     netcontext.Context
 )
 
+// headerSpellings maps the keys of headers forwarded on API calls to
+// their conventional spelling, for use when canonicalization is disabled.
+var headerSpellings = map[string]string{
+	dapperHeader:          "X-Google-DapperTraceInfo",
+	traceHeader:           "X-Cloud-Trace-Context",
+	authContextHeader:     "X-AppEngine-Auth-Context",
+	apiAttachmentHeader:   "X-Google-RPC-Attachment",
+	apiBackendShardHeader: "X-Google-RPC-Backend-Shard",
+	apiIfNoneMatchHeader:  "X-Google-RPC-If-None-Match",
+	apiCallIDHeader:       "X-Google-RPC-Call-Id",
+}
+
+var canonicalHeaders int32 = 1 // atomic; 1 if enabled
+
+// SetCanonicalHeaders controls whether headers forwarded on API calls are
+// sent with Go's canonical key casing, which is the default. When disabled,
+// they are sent exactly as App Engine spells them, for backends that are
+// sensitive to header case.
+func SetCanonicalHeaders(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&canonicalHeaders, v)
+}
+
+// apiClient returns the HTTP client for API calls, which uses a connection
+// of its own for each call if fresh is set.
+func apiClient(fresh bool) *http.Client {
+	if fresh {
+		return freshHTTPClient
+	}
+	return apiHTTPClient
+}
+
+// setOutHeader sets a header forwarded on an API call, spelling its key
+// as SetCanonicalHeaders requires.
+func setOutHeader(h http.Header, key, value string) {
+	if atomic.LoadInt32(&canonicalHeaders) != 0 {
+		h.Set(key, value)
+		return
+	}
+	if s, ok := headerSpellings[key]; ok {
+		key = s
+	}
+	h[key] = []string{value}
+}
+
+var apiPathOverride struct {
+	sync.RWMutex
+	path string
+}
+
+// SetAPIPath changes the path of the service bridge endpoint that API calls
+// are posted to, for bridges that serve it elsewhere. The empty string
+// restores the default, /rpc_http.
+func SetAPIPath(path string) {
+	apiPathOverride.Lock()
+	apiPathOverride.path = path
+	apiPathOverride.Unlock()
+}
+
+// currentAPIPath returns the path of the service bridge endpoint.
+func currentAPIPath() string {
+	apiPathOverride.RLock()
+	defer apiPathOverride.RUnlock()
+	if apiPathOverride.path != "" {
+		return apiPathOverride.path
+	}
+	return apiPath
+}
+
 func apiURL() *url.URL {
 	host, port := "appengine.googleapis.internal", "10001"
 	if h := os.Getenv("API_HOST"); h != "" {
@@ -80,46 +195,66 @@ func apiURL() *url.URL {
 	return &url.URL{
 		Scheme: "http",
 		Host:   host + ":" + port,
-		Path:   apiPath,
+		Path:   currentAPIPath(),
 	}
 }
 
 func handleHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	c := &context{
 		req:       r,
 		outHeader: w.Header(),
 		apiURL:    apiURL(),
 	}
+	startRequest(c)
+	defer finishRequest(c)
 	r = r.WithContext(withContext(r.Context(), c))
 	c.req = r
+	c.experiments = parseExperiments(r.Header[experimentHeaderName()])
+	c.authContext = parseAuthContext(r.Header)
+	c.cron = r.Header.Get(cronHeader) == "true"
+	c.taskInfo = parseTaskInfo(r.Header)
+	c.apiVersion = r.Header.Get(apiVersionHeader)
+	c.traceSampled = parseTraceSampled(r.Header)
+	c.peerIdentity = parsePeerIdentity(r.Header)
+	c.defaultVersionHostname = r.Header.Get(hDefaultVersionHostname)
+	if d := parseTimeout(r.Header); d > 0 {
+		// Calls made while serving the request can't outlast its budget.
+		c.deadline = start.Add(d)
+	}
 
 	stopFlushing := make(chan int)
 
 	// Patch up RemoteAddr so it looks reasonable.
-	if addr := r.Header.Get(userIPHeader); addr != "" {
-		r.RemoteAddr = addr
-	} else if addr = r.Header.Get(remoteAddrHeader); addr != "" {
-		r.RemoteAddr = addr
-	} else {
-		// Should not normally reach here, but pick a sensible default anyway.
-		r.RemoteAddr = "127.0.0.1"
-	}
-	// The address in the headers will most likely be of these forms:
-	//	123.123.123.123
-	//	2001:db8::1
-	// net/http.Request.RemoteAddr is specified to be in "IP:port" form.
-	if _, _, err := net.SplitHostPort(r.RemoteAddr); err != nil {
-		// Assume the remote address is only a host; add a default port.
-		r.RemoteAddr = net.JoinHostPort(r.RemoteAddr, "80")
-	}
+	r.RemoteAddr = remoteAddr(r.Header)
+	c.logRequestStart()
 
 	// Start goroutine responsible for flushing app logs.
 	// This is done after adding c to ctx.m (and stopped before removing it)
 	// because flushing logs requires making an API call.
-	go c.logFlusher(stopFlushing)
-
-	executeRequestSafely(c, r)
+	goBackground(func() { c.logFlusher(stopFlushing) })
+
+	if err := decodeRequestBody(r); err != nil {
+		logf(c, 2, "Rejecting request with a bad body: %v", err) // warning level
+		http.Error(c, "Bad Request", http.StatusBadRequest)
+	} else if err := verifyInbound(r); err != nil {
+		logf(c, 2, "Rejecting request that failed verification: %v", err) // warning level
+		http.Error(c, "Forbidden", http.StatusForbidden)
+	} else {
+		executeRequestSafely(c, r)
+	}
 	c.outHeader = nil // make sure header changes aren't respected any more
+	c.runDeferred()
+
+	if errs := c.SoftErrors(); len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		logf(c, 2, "%d soft error(s) during request: %s", len(errs), strings.Join(msgs, "; ")) // warning level
+	}
+	c.logRequestSummary(time.Since(start))
+	c.logRequestEnd(time.Since(start))
 
 	stopFlushing <- 1 // any logging beyond this point will be dropped
 
@@ -129,15 +264,19 @@ func handleHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(c.pendingLogs.lines) > 0 {
 		flushes++
 	}
+	dropped := c.pendingLogs.dropped
 	c.pendingLogs.Unlock()
 	flushed := make(chan struct{})
-	go func() {
+	goBackground(func() {
 		defer close(flushed)
 		// Force a log flush, because with very short requests we
 		// may not ever flush logs.
 		c.flushLog(true)
-	}()
+	})
 	w.Header().Set(logFlushHeader, strconv.Itoa(flushes))
+	if dropped > 0 {
+		w.Header().Set(logTruncatedHeader, strconv.Itoa(dropped))
+	}
 
 	// Avoid nil Write call if c.Write is never called.
 	if c.outCode != 0 {
@@ -151,6 +290,58 @@ func handleHTTP(w http.ResponseWriter, r *http.Request) {
 	<-flushed
 }
 
+// remoteAddr returns the address of the client of an inbound request with
+// the headers h, in the "IP:port" form of net/http.Request.RemoteAddr.
+// X-AppEngine-Remote-Addr takes precedence over X-AppEngine-User-IP if both
+// are present. Values that aren't addresses are ignored.
+func remoteAddr(h http.Header) string {
+	for _, v := range [...]string{h.Get(remoteAddrHeader), h.Get(userIPHeader)} {
+		// The address in the headers will most likely be of these forms:
+		//	123.123.123.123
+		//	2001:db8::1
+		v = strings.TrimSpace(v)
+		if net.ParseIP(v) != nil {
+			// Only a host; add a default port.
+			return net.JoinHostPort(v, "80")
+		}
+		if host, _, err := net.SplitHostPort(v); err == nil && net.ParseIP(host) != nil {
+			return v
+		}
+	}
+	// Should not normally reach here, but pick a sensible default anyway.
+	return "127.0.0.1:80"
+}
+
+// requestsInFlight tracks requests until their logs have been flushed.
+var requestsInFlight struct {
+	sync.Mutex
+	n        int
+	contexts map[*context]bool
+}
+
+// requestsIdle is signaled when requestsInFlight drops to zero.
+var requestsIdle = sync.NewCond(&requestsInFlight)
+
+func startRequest(c *context) {
+	requestsInFlight.Lock()
+	requestsInFlight.n++
+	if requestsInFlight.contexts == nil {
+		requestsInFlight.contexts = make(map[*context]bool)
+	}
+	requestsInFlight.contexts[c] = true
+	requestsInFlight.Unlock()
+}
+
+func finishRequest(c *context) {
+	requestsInFlight.Lock()
+	requestsInFlight.n--
+	delete(requestsInFlight.contexts, c)
+	if requestsInFlight.n == 0 {
+		requestsIdle.Broadcast()
+	}
+	requestsInFlight.Unlock()
+}
+
 func executeRequestSafely(c *context, r *http.Request) {
 	defer func() {
 		if x := recover(); x != nil {
@@ -214,9 +405,60 @@ type context struct {
 		sync.Mutex
 		lines   []*logpb.UserAppLogLine
 		flushes int
+		dropped int // lines discarded because the buffer was full
+
+		lastFlush time.Time // when logs were last flushed successfully
 	}
+	flushMu sync.Mutex // held while flushing logs
 
 	apiURL *url.URL
+
+	experiments map[string]string
+	authContext string // sanitized user information, for forwarding to the API
+	cron        bool   // whether the request was made by the cron service
+	taskInfo    TaskInfo
+	apiVersion  string
+
+	defaultVersionHostname string
+	traceSampled           bool   // whether the inbound request was sampled for tracing
+	peerIdentity           string // verified identity of the calling service, if any
+
+	softErrors struct {
+		sync.Mutex
+		errs []error
+	}
+
+	limiters struct {
+		sync.Mutex
+		m map[string]*rateLimiter // by service
+	}
+	callTotals struct {
+		sync.Mutex
+		calls, errors int
+		elapsed       time.Duration
+	}
+	callSlots struct {
+		sync.Mutex
+		ch chan struct{} // holds a value for each call in flight; nil if unlimited
+	}
+	memo struct {
+		sync.Mutex
+		m map[string]*memoEntry
+	}
+	counters struct {
+		sync.Mutex
+		m map[string]int64 // by name
+	}
+	deferred struct {
+		sync.Mutex
+		fns []func() // registered with Defer
+	}
+
+	// deadline, if non-zero, bounds the timeout of calls made with this context.
+	deadline time.Time
+	// parent is the context this one was derived from by ChildContext.
+	// Logs are buffered and flushed by the parent.
+	parent *context
 }
 
 var contextKey = "holds a *context"
@@ -381,28 +623,91 @@ func (c *context) WriteHeader(code int) {
 	c.outCode = code
 }
 
-func (c *context) post(body []byte, timeout time.Duration) (b []byte, err error) {
+// post sends an encoded service bridge request and returns the encoded response.
+// If w is non-nil, the response message is copied to w as it arrives, rather
+// than being returned, and only the rest of the response is returned.
+func (c *context) post(ctx netcontext.Context, body io.ReadCloser, n int, timeout time.Duration, opts *CallOptions, info *CallInfo, w io.Writer) (b []byte, err error) {
+	u := c.apiURL
+	resolved := false
+	if ru, ok, err := resolveAPIURL(); ok {
+		if err != nil {
+			body.Close()
+			return nil, &CallError{
+				Detail: fmt.Sprintf("resolving API host: %v", err),
+				Code:   int32(remotepb.RpcError_UNKNOWN),
+			}
+		}
+		u, resolved = ru, true
+	}
+	if u.Host == "" {
+		body.Close()
+		return nil, &CallError{
+			Detail: "service bridge HTTP failed: API host unset",
+			Code:   int32(remotepb.RpcError_UNKNOWN),
+		}
+	}
 	hreq := &http.Request{
 		Method: "POST",
-		URL:    c.apiURL,
+		URL:    u,
 		Header: http.Header{
 			apiEndpointHeader: apiEndpointHeaderValue,
 			apiMethodHeader:   apiMethodHeaderValue,
 			apiContentType:    apiContentTypeValue,
+			apiAcceptEncoding: apiAcceptEncodingValue,
 			apiDeadlineHeader: []string{strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64)},
 		},
-		Body:          ioutil.NopCloser(bytes.NewReader(body)),
-		ContentLength: int64(len(body)),
-		Host:          c.apiURL.Host,
+		Body:          body,
+		ContentLength: int64(n),
+		Host:          u.Host,
+	}
+	for k, vs := range opts.Headers {
+		if !reservedHeader(http.CanonicalHeaderKey(k)) {
+			hreq.Header[k] = vs
+		}
 	}
 	if info := c.req.Header.Get(dapperHeader); info != "" {
-		hreq.Header.Set(dapperHeader, info)
+		setOutHeader(hreq.Header, dapperHeader, info)
 	}
 	if info := c.req.Header.Get(traceHeader); info != "" {
-		hreq.Header.Set(traceHeader, info)
+		if opts.ParentSpanID != "" {
+			info = withParentSpan(info, opts.ParentSpanID)
+		}
+		setOutHeader(hreq.Header, traceHeader, info)
+	}
+	if c.authContext != "" && atomic.LoadInt32(&forwardAuthContext) != 0 {
+		setOutHeader(hreq.Header, authContextHeader, c.authContext)
+	}
+	if opts.Attachment != nil {
+		setOutHeader(hreq.Header, apiAttachmentHeader, base64.StdEncoding.EncodeToString(opts.Attachment))
+	}
+	if opts.BackendShard != "" {
+		setOutHeader(hreq.Header, apiBackendShardHeader, opts.BackendShard)
+	}
+	if opts.IfNoneMatch != "" {
+		setOutHeader(hreq.Header, apiIfNoneMatchHeader, opts.IfNoneMatch)
+	}
+	if info.CallID != "" {
+		setOutHeader(hreq.Header, apiCallIDHeader, info.CallID)
 	}
 
-	tr := apiHTTPClient.Transport.(*http.Transport)
+	if opts.OnComplete != nil {
+		// Only trace calls that are observed, as tracing isn't free.
+		var sent int64 // atomic; set by the transport's writer, read by its reader
+		hreq = hreq.WithContext(httptrace.WithClientTrace(hreq.Context(), &httptrace.ClientTrace{
+			WroteRequest: func(httptrace.WroteRequestInfo) {
+				atomic.StoreInt64(&sent, time.Now().UnixNano())
+			},
+			GotConn: func(ci httptrace.GotConnInfo) {
+				info.RemoteAddr = ci.Conn.RemoteAddr().String()
+			},
+			GotFirstResponseByte: func() {
+				info.TimeToFirstByte = time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&sent))
+			},
+		}))
+	}
+
+	client := apiClient(opts.FreshConnection)
+	tr := client.Transport.(*http.Transport)
 
 	var timedOut int32 // atomic; set to 1 if timed out
 	t := time.AfterFunc(timeout, func() {
@@ -417,39 +722,424 @@ func (c *context) post(body []byte, timeout time.Duration) (b []byte, err error)
 		}
 	}()
 
-	hresp, err := apiHTTPClient.Do(hreq)
+	hresp, err := client.Do(hreq)
+	if resolved {
+		resolvedDialResult(err)
+	}
 	if err != nil {
 		return nil, &CallError{
-			Detail: fmt.Sprintf("service bridge HTTP failed: %v", err),
+			Detail: requestFailure(err),
 			Code:   int32(remotepb.RpcError_UNKNOWN),
 		}
 	}
 	defer hresp.Body.Close()
-	hrespBody, err := ioutil.ReadAll(hresp.Body)
+	if hresp.StatusCode == http.StatusNotModified && opts.IfNoneMatch != "" {
+		return nil, errNotModified
+	}
+	if hresp.StatusCode >= 300 && hresp.StatusCode < 400 {
+		return nil, &CallError{
+			Detail: fmt.Sprintf("service bridge redirected with HTTP %d to %q; redirects are not followed", hresp.StatusCode, hresp.Header.Get("Location")),
+			Code:   int32(remotepb.RpcError_UNKNOWN),
+		}
+	}
 	if hresp.StatusCode != 200 {
+		hrespBody, _ := ioutil.ReadAll(hresp.Body)
 		return nil, &CallError{
 			Detail: fmt.Sprintf("service bridge returned HTTP %d (%q)", hresp.StatusCode, hrespBody),
 			Code:   int32(remotepb.RpcError_UNKNOWN),
 		}
 	}
+	enc, decoded, err := decodeResponse(hresp)
 	if err != nil {
 		return nil, &CallError{
 			Detail: fmt.Sprintf("service bridge response bad: %v", err),
 			Code:   int32(remotepb.RpcError_UNKNOWN),
 		}
 	}
+	var hrespBody []byte
+	read := 0
+	switch {
+	case w != nil:
+		hrespBody, read, err = streamResponse(decoded, w, opts.MaxResponseSize)
+		switch err := err.(type) {
+		case *streamWriteError:
+			return nil, err.err
+		case *CallError:
+			return nil, err
+		}
+	case enc != "":
+		hrespBody, err = readLimited(decoded, maxDecompressedSize)
+	default:
+		hrespBody, err = ioutil.ReadAll(decoded)
+		read = len(hrespBody)
+	}
+	if err == nil && enc != "" {
+		// Read to the end of the encoded body, so that its trailers are set.
+		_, err = io.Copy(ioutil.Discard, hresp.Body)
+	}
+	if err != nil && enc != "" {
+		// The read counts of compressed responses aren't meaningful.
+		return nil, &CallError{
+			Detail: fmt.Sprintf("service bridge response bad: %s: %v", enc, err),
+			Code:   int32(remotepb.RpcError_UNKNOWN),
+		}
+	}
+	if err != nil {
+		return nil, &CallError{
+			Detail: responseReadFailure(hresp, read, err),
+			Code:   int32(remotepb.RpcError_UNKNOWN),
+		}
+	}
+	if w == nil && isGzip(hrespBody) {
+		// The response was compressed but not labeled as such.
+		n := len(hrespBody)
+		if hrespBody, err = gunzip(hrespBody); err != nil {
+			return nil, &CallError{
+				Detail: fmt.Sprintf("service bridge response bad: gzip: %v", err),
+				Code:   int32(remotepb.RpcError_UNKNOWN),
+			}
+		}
+		callLogf(ctx, c, 0, "service bridge response was gzipped without Content-Encoding; decompressed %d bytes to %d", n, len(hrespBody)) // debug level
+	}
+	if code := hresp.Trailer.Get(apiErrorCodeTrailer); code != "" {
+		ce := &CallError{
+			Detail: hresp.Trailer.Get(apiErrorDetailTrailer),
+			Code:   int32(remotepb.RpcError_UNKNOWN),
+		}
+		if n, err := strconv.ParseInt(code, 10, 32); err == nil {
+			ce.Code = int32(n)
+		}
+		switch remotepb.RpcError_ErrorCode(ce.Code) {
+		case remotepb.RpcError_CANCELLED, remotepb.RpcError_DEADLINE_EXCEEDED:
+			ce.Timeout = true
+		}
+		return nil, ce
+	}
+	if opts.ResponseAttachment != nil {
+		att, err := base64.StdEncoding.DecodeString(hresp.Header.Get(apiAttachmentHeader))
+		if err != nil {
+			return nil, &CallError{
+				Detail: fmt.Sprintf("service bridge attachment bad: %v", err),
+				Code:   int32(remotepb.RpcError_UNKNOWN),
+			}
+		}
+		*opts.ResponseAttachment = att
+	}
 	return hrespBody, nil
 }
 
+// noRedirects stops the API HTTP clients from following redirects,
+// which a correctly configured service bridge never sends.
+func noRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// errNotModified is returned by post when the service bridge reports that
+// the response of a conditional call is unchanged.
+var errNotModified = errors.New("response not modified")
+
+// withParentSpan returns the trace context info, which is of the form
+// TRACE_ID/SPAN_ID;o=OPTIONS, with its span ID replaced by span.
+func withParentSpan(info, span string) string {
+	var options string
+	if i := strings.Index(info, ";"); i >= 0 {
+		info, options = info[:i], info[i:]
+	}
+	if i := strings.Index(info, "/"); i >= 0 {
+		info = info[:i]
+	}
+	return info + "/" + span + options
+}
+
+// responseReadFailure describes an error reading a service bridge response body.
+// It distinguishes a bridge that sent less than it promised from a connection
+// that was torn down under the response, as they have different causes.
+func responseReadFailure(hresp *http.Response, n int, err error) string {
+	switch {
+	case isConnReset(err):
+		return fmt.Sprintf("service bridge connection reset after %d response bytes: %v", n, err)
+	case err == io.ErrUnexpectedEOF:
+		return fmt.Sprintf("service bridge response truncated: got %d of %d bytes", n, hresp.ContentLength)
+	}
+	return fmt.Sprintf("service bridge response bad: %v", err)
+}
+
+// requestFailure describes an error sending a service bridge request.
+// It distinguishes the ways dialing the bridge fails, as they have
+// different causes.
+func requestFailure(err error) string {
+	e := err
+	if ue, ok := e.(*url.Error); ok {
+		e = ue.Err
+	}
+	if oe, ok := e.(*net.OpError); ok && oe.Op == "dial" {
+		switch {
+		case oe.Timeout():
+			return fmt.Sprintf("service bridge dial timeout: %v", err)
+		case syscallErr(oe) == syscall.ECONNREFUSED:
+			return fmt.Sprintf("service bridge connection refused: %v", err)
+		}
+	}
+	return fmt.Sprintf("service bridge HTTP failed: %v", err)
+}
+
+// isConnReset reports whether err was caused by the peer resetting the connection.
+func isConnReset(err error) bool {
+	return syscallErr(err) == syscall.ECONNRESET
+}
+
+// syscallErr returns the system call error underlying a network error.
+func syscallErr(err error) error {
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err
+}
+
+// marshalRequest encodes an API request message. If deterministic is set,
+// identical messages always encode to identical bytes, which otherwise isn't
+// guaranteed for messages with map fields. A message that can't be encoded,
+// such as for want of a required field, is reported as a *CallError.
+func marshalRequest(in proto.Message, deterministic bool) ([]byte, error) {
+	var data []byte
+	var err error
+	if deterministic {
+		var b proto.Buffer
+		b.SetDeterministic(true)
+		err = b.Marshal(in)
+		data = b.Bytes()
+	} else {
+		data, err = proto.Marshal(in)
+	}
+	if err != nil {
+		return nil, &CallError{
+			Detail: fmt.Sprintf("bad request message %T: %v", in, err),
+			Code:   int32(remotepb.RpcError_BAD_REQUEST),
+		}
+	}
+	return data, nil
+}
+
+// callTimeout computes the timeout, as of now, for a call from the call
+// options, the service's class, the deadline of ctx and that of c.
+func (c *context) callTimeout(now time.Time, ctx netcontext.Context, service, method string, opts *CallOptions) time.Duration {
+	// Default RPC timeout is 60s.
+	timeout := 60 * time.Second
+	// The timeouts of a service class and of the call options are limits
+	// that the context cannot extend, unlike the default.
+	limited := false
+	if d, ok := serviceClassTimeout(service); ok {
+		timeout, limited = d, true
+	}
+	if opts.Timeout > 0 {
+		if !limited || opts.Timeout < timeout {
+			timeout = opts.Timeout
+		}
+		limited = true
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if d := deadline.Sub(now); !limited || d < timeout {
+			timeout = d
+		}
+	}
+	if !c.deadline.IsZero() && !isLogFlush(service, method) {
+		// Logs are flushed even once the budget is spent, or a request
+		// that overran it would lose them.
+		if d := c.deadline.Sub(now); d < timeout {
+			timeout = d
+		}
+	}
+
+	deadlineOverride.RLock()
+	f := deadlineOverride.f
+	deadlineOverride.RUnlock()
+	if f != nil {
+		timeout = f(service, method, now.Add(timeout)).Sub(now)
+	}
+	return timeout
+}
+
+// EffectiveDeadline returns the deadline that a call to service.method made
+// with c and opts would have, without making the call. Deadlines of derived
+// netcontext.Contexts are not taken into account. opts may be nil.
+func (c *context) EffectiveDeadline(service, method string, opts *CallOptions) time.Time {
+	if opts == nil {
+		opts = noCallOptions
+	}
+	now := time.Now()
+	return now.Add(c.callTimeout(now, netcontext.Background(), service, method, opts))
+}
+
+var deadlineOverride struct {
+	sync.RWMutex
+	f func(service, method string, deadline time.Time) time.Time
+}
+
+// SetDeadlineOverride installs a function that may replace the deadline
+// computed for each call. A nil f removes the override.
+func SetDeadlineOverride(f func(service, method string, deadline time.Time) time.Time) {
+	deadlineOverride.Lock()
+	deadlineOverride.f = f
+	deadlineOverride.Unlock()
+}
+
+var softDeadlineRatio struct {
+	sync.RWMutex
+	r float64
+}
+
+// SetSoftDeadlineRatio causes a warning to be logged for each successful call
+// that takes more than the fraction r of its timeout, so that timeouts can be
+// tuned before calls start failing. An r of zero or less disables the warning,
+// as it is by default.
+func SetSoftDeadlineRatio(r float64) {
+	softDeadlineRatio.Lock()
+	softDeadlineRatio.r = r
+	softDeadlineRatio.Unlock()
+}
+
+// checkSoftDeadline logs the warning enabled by SetSoftDeadlineRatio
+// if a call that took elapsed used too much of its timeout.
+func (c *context) checkSoftDeadline(ctx netcontext.Context, service, method string, elapsed, timeout time.Duration) {
+	softDeadlineRatio.RLock()
+	r := softDeadlineRatio.r
+	softDeadlineRatio.RUnlock()
+	if r <= 0 || timeout <= 0 || float64(elapsed) <= r*float64(timeout) {
+		return
+	}
+	callLogf(ctx, c, 2, "API call %s.%s took %v, %.0f%% of its %v timeout", service, method, elapsed, 100*float64(elapsed)/float64(timeout), timeout) // warning level
+}
+
+var callRewriter struct {
+	sync.RWMutex
+	f func(service, method string) (string, string)
+}
+
+// SetCallRewriter installs a function that maps the service and method
+// of each call to the ones it is sent to, such as while moving callers
+// from one backend to another. A nil f removes the rewriter.
+func SetCallRewriter(f func(service, method string) (string, string)) {
+	callRewriter.Lock()
+	callRewriter.f = f
+	callRewriter.Unlock()
+}
+
+var errorMapper struct {
+	sync.RWMutex
+	f func(*CallError) error
+}
+
+// SetErrorMapper installs a function that may replace the *CallError
+// a call fails with, such as to translate error codes into errors of the
+// application's own. If f returns nil, the *CallError is returned unchanged.
+// f must not modify its argument. A nil f removes the mapper.
+// It isn't applied to the errors of the package's own log flushes.
+func SetErrorMapper(f func(*CallError) error) {
+	errorMapper.Lock()
+	errorMapper.f = f
+	errorMapper.Unlock()
+}
+
+// mapError applies the function installed with SetErrorMapper to err.
+func mapError(err error) error {
+	ce, ok := err.(*CallError)
+	if !ok {
+		return err
+	}
+	errorMapper.RLock()
+	f := errorMapper.f
+	errorMapper.RUnlock()
+	if f == nil {
+		return err
+	}
+	if mapped := f(ce); mapped != nil {
+		return mapped
+	}
+	return err
+}
+
+// CallInfo describes a completed API call.
+type CallInfo struct {
+	CallID   string // identifies the call in logs and errors
+	Service  string
+	Method   string
+	Duration time.Duration
+	Err      error // the error returned by Call
+
+	// Stale is set if the call failed and was answered with an earlier
+	// response instead, as requested by CallOptions.ServeStaleOnError.
+	Stale bool
+
+	// TimeToFirstByte is how long the service bridge took to start
+	// responding once the request was sent. It is zero if no response came.
+	TimeToFirstByte time.Duration
+
+	// RemoteAddr is the address of the service bridge host that served
+	// the call, which may be one of several the API host resolves to.
+	// It is empty if no connection was made.
+	RemoteAddr string
+
+	// BackendShard is the shard the call was routed to,
+	// as requested by CallOptions.BackendShard.
+	BackendShard string
+
+	// MarshalTime and UnmarshalTime are how long encoding the request
+	// message and decoding the response message took, in the last attempt
+	// of the call. They are zero for steps that weren't reached.
+	MarshalTime   time.Duration
+	UnmarshalTime time.Duration
+}
+
+var lastCallID uint64 // atomic
+
+// newCallID returns a short identifier, unique within this process, for an API call.
+func newCallID() string {
+	return strconv.FormatUint(atomic.AddUint64(&lastCallID, 1), 16)
+}
+
+// admitCall returns an error if a call to service.method made with c must
+// not be made, because the instance is draining or SetMethodPolicy disabled
+// the method. The call must already be counted in callsInFlight, so that
+// BeginDrain can't find no calls in flight while this one goes ahead.
+func (c *context) admitCall(ctx netcontext.Context, service, method string) error {
+	if isDraining(service, method) {
+		return errDraining
+	}
+	if err := checkMethodPolicy(service, method); err != nil {
+		callLogf(ctx, c, 2, "API call blocked by policy: %v", err) // warning level
+		return err
+	}
+	return nil
+}
+
 func Call(ctx netcontext.Context, service, method string, in, out proto.Message) error {
+	callRewriter.RLock()
+	rewrite := callRewriter.f
+	callRewriter.RUnlock()
+	if rewrite != nil {
+		service, method = rewrite(service, method)
+	}
+
 	if ns := NamespaceFromContext(ctx); ns != "" {
 		if fn, ok := NamespaceMods[service]; ok {
 			fn(in, ns)
 		}
 	}
 
-	if f, ctx, ok := callOverrideFromContext(ctx); ok {
-		return f(ctx, service, method, in, out)
+	opts := callOptionsFromContext(ctx)
+	var callID string
+	if opts.CorrelateLogs {
+		callID = newCallID()
+		ctx = withCallLogTags(ctx, callID, service)
+	}
+
+	if !opts.SkipInterceptors {
+		if f, ctx, ok := callOverrideFromContext(ctx); ok {
+			return f(ctx, service, method, in, out)
+		}
 	}
 
 	// Handle already-done contexts quickly.
@@ -464,6 +1154,11 @@ func Call(ctx netcontext.Context, service, method string, in, out proto.Message)
 		// Give a good error message rather than a panic lower down.
 		return errNotAppEngineContext
 	}
+	atomic.AddInt32(&callsInFlight, 1)
+	defer endCall()
+	if err := c.admitCall(ctx, service, method); err != nil {
+		return err
+	}
 
 	// Apply transaction modifications if we're in a transaction.
 	if t := transactionFromContext(ctx); t != nil {
@@ -473,17 +1168,302 @@ func Call(ctx netcontext.Context, service, method string, in, out proto.Message)
 		applyTransaction(in, &t.transaction)
 	}
 
-	// Default RPC timeout is 60s.
-	timeout := 60 * time.Second
-	if deadline, ok := ctx.Deadline(); ok {
-		timeout = deadline.Sub(time.Now())
+	if callID == "" {
+		callID = newCallID()
+	}
+	info := CallInfo{
+		CallID:       callID,
+		Service:      service,
+		Method:       method,
+		BackendShard: opts.BackendShard,
+	}
+	start := time.Now()
+	var err error
+	if len(opts.EscalatingDeadlines) > 0 {
+		err = c.callEscalating(ctx, service, method, in, out, opts, &info)
+	} else {
+		err = c.call(ctx, service, method, in, out, opts, &info)
+	}
+	for i := 0; i < opts.Retries && retryable(ctx, err); i++ {
+		out.Reset()
+		err = c.call(ctx, service, method, in, out, opts, &info)
+	}
+	if _, ok := err.(*CallError); ok && opts.ServeStaleOnError {
+		if b, ok := staleLookup(service, method, in); ok && proto.Unmarshal(b, out) == nil {
+			c.RecordSoftError(fmt.Errorf("serving stale response to %s.%s: %v", service, method, err))
+			info.Stale = true
+			err = nil
+		}
+	}
+	info.Duration = time.Since(start)
+	switch e := err.(type) {
+	case *CallError:
+		// errTimeout is shared, and compared against, so it is left alone.
+		if e != errTimeout {
+			e.CallID = info.CallID
+		}
+	case *APIError:
+		e.CallID = info.CallID
+	}
+	if !isLogFlush(service, method) {
+		// The package's own log flushes need their errors as they are.
+		err = mapError(err)
+	}
+	info.Err = err
+	c.recordCall(&info)
+	recordCallStats(&info, opts)
+	recordSlowCall(&info, start)
+	if opts.LogCallID {
+		logf(c, 0, "API call %s.%s [%s] took %v (err=%v)", service, method, info.CallID, info.Duration, err) // debug level
+	}
+	if opts.OnComplete != nil {
+		opts.OnComplete(info)
+	}
+	return err
+}
+
+// normalizeTicket removes the corruption a security ticket commonly picks up
+// on its way through configuration: surrounding whitespace and quotes.
+func normalizeTicket(ticket string) string {
+	t := strings.TrimSpace(ticket)
+	if len(t) >= 2 && t[0] == '"' && t[len(t)-1] == '"' {
+		t = strings.TrimSpace(t[1 : len(t)-1])
+	}
+	return t
+}
+
+// retryable reports whether a call that failed with err may be attempted
+// again. Only failures that may be transient are retried; others, such as a
+// bad request or an exhausted quota, would fail the same way again.
+func retryable(ctx netcontext.Context, err error) bool {
+	ce, ok := err.(*CallError)
+	if !ok || ce.Timeout {
+		return false
+	}
+	switch remotepb.RpcError_ErrorCode(ce.Code) {
+	case remotepb.RpcError_UNKNOWN, remotepb.RpcError_CANCELLED:
+	default:
+		return false
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// callEscalating makes the attempts of a call with opts.EscalatingDeadlines,
+// each with the next of the deadlines, for as long as they time out.
+func (c *context) callEscalating(ctx netcontext.Context, service, method string, in, out proto.Message, opts *CallOptions, info *CallInfo) error {
+	var err error
+	for i, d := range opts.EscalatingDeadlines {
+		if i > 0 {
+			if ce, ok := err.(*CallError); !ok || !ce.Timeout || ctx.Err() != nil {
+				break
+			}
+			out.Reset()
+		}
+		attempt := *opts
+		attempt.Timeout = d
+		err = c.call(ctx, service, method, in, out, &attempt, info)
+	}
+	return err
+}
+
+// call makes an API call on behalf of Call, once the call has been
+// resolved to a context and its options. It records details of the call in info.
+func (c *context) call(ctx netcontext.Context, service, method string, in, out proto.Message, opts *CallOptions, info *CallInfo) error {
+	info.MarshalTime, info.UnmarshalTime = 0, 0
+	marshalStart := time.Now()
+	data, err := marshalRequest(in, opts.Deterministic)
+	info.MarshalTime = time.Since(marshalStart)
+	if err != nil {
+		return err
+	}
+
+	var dk dedupKey
+	if opts.IdempotencyKey != "" {
+		dk = dedupKey{service, method, opts.IdempotencyKey}
+		b, ok, err := dedupLookup(dk, data)
+		if err != nil {
+			return err
+		}
+		if ok {
+			// This call already succeeded; don't repeat its side effects.
+			return proto.Unmarshal(b, out)
+		}
+	}
+
+	if err := checkHeaderOptions(opts); err != nil {
+		return err
+	}
+
+	if err := c.waitRateLimit(ctx, service); err != nil {
+		return err
+	}
+	release, err := c.acquireCallSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	start := time.Now()
+	timeout := c.callTimeout(start, ctx, service, method, opts)
+	if opts.MinBudget > 0 && timeout < opts.MinBudget {
+		// The call couldn't finish in time; don't waste the effort.
+		return &CallError{
+			Detail:  fmt.Sprintf("insufficient budget: %v left, want at least %v", timeout, opts.MinBudget),
+			Code:    int32(remotepb.RpcError_CANCELLED),
+			Timeout: true,
+		}
 	}
 
-	data, err := proto.Marshal(in)
+	hreqBody, n, err := c.encodeCall(ctx, service, method, data, opts)
 	if err != nil {
 		return err
 	}
 
+	hrespBody, err := c.post(ctx, hreqBody, n, timeout, opts, info, nil)
+	if opts.NotModified != nil {
+		*opts.NotModified = err == errNotModified
+	}
+	if err == errNotModified {
+		// The caller's copy of the response is current; leave out alone.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	res := &remotepb.Response{}
+	if err := proto.Unmarshal(hrespBody, res); err != nil {
+		return err
+	}
+	if opts.ResultCode != nil {
+		*opts.ResultCode = 0
+	}
+	if err := responseError(service, res); err != nil {
+		if ae, ok := err.(*APIError); ok && acceptedCode(opts.AcceptCodes, ae.Code) {
+			// The caller takes this error to be a normal outcome.
+			if opts.ResultCode != nil {
+				*opts.ResultCode = ae.Code
+			}
+			return nil
+		}
+		return err
+	}
+	if _, void := out.(*basepb.VoidProto); opts.RequireNonEmptyResponse && !void && len(res.Response) == 0 {
+		return &CallError{
+			Detail: "service returned an empty response",
+			Code:   int32(remotepb.RpcError_UNKNOWN),
+		}
+	}
+	if opts.MaxResponseSize > 0 && int64(len(res.Response)) > opts.MaxResponseSize {
+		return responseTooLarge(opts.MaxResponseSize)
+	}
+	unmarshalStart := time.Now()
+	err = proto.Unmarshal(res.Response, out)
+	info.UnmarshalTime = time.Since(unmarshalStart)
+	if err != nil {
+		return err
+	}
+	if opts.ValidateResponse != nil {
+		if err := opts.ValidateResponse(out); err != nil {
+			return &CallError{
+				Detail: "invalid response: " + err.Error(),
+				Code:   int32(remotepb.RpcError_UNKNOWN),
+			}
+		}
+	}
+	if opts.IdempotencyKey != "" {
+		dedupRecord(dk, data, res.Response)
+	}
+	if opts.ServeStaleOnError {
+		staleRecord(service, method, in, res.Response)
+	}
+	c.checkSoftDeadline(ctx, service, method, time.Since(start), timeout)
+	return nil
+}
+
+// checkHeaderOptions returns an error if the call options that are
+// forwarded in headers, such as opts.ParentSpanID, can't be sent.
+func checkHeaderOptions(opts *CallOptions) error {
+	for _, o := range [...]struct{ name, value string }{
+		{"parent span ID", opts.ParentSpanID},
+		{"backend shard", opts.BackendShard},
+		{"If-None-Match tag", opts.IfNoneMatch},
+	} {
+		if strings.ContainsAny(o.value, "\r\n") {
+			// Don't let a line break in a value from the caller corrupt the request.
+			return &CallError{
+				Detail: fmt.Sprintf("invalid %s %q: contains a line break", o.name, o.value),
+				Code:   int32(remotepb.RpcError_BAD_REQUEST),
+			}
+		}
+	}
+	for k, vs := range opts.Headers {
+		for _, v := range vs {
+			if strings.ContainsAny(k+v, "\r\n") {
+				return &CallError{
+					Detail: fmt.Sprintf("invalid header %q: contains a line break", k),
+					Code:   int32(remotepb.RpcError_BAD_REQUEST),
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// reservedHeader reports whether the header with the canonical key is one
+// that API calls set themselves, and so can't be set with CallOptions.Headers.
+func reservedHeader(key string) bool {
+	if _, ok := headerSpellings[key]; ok {
+		return true
+	}
+	switch key {
+	case apiContentType, apiAcceptEncoding, ticketHeader,
+		"Connection", "Content-Encoding", "Content-Length", "Host", "Transfer-Encoding":
+		return true
+	}
+	return strings.HasPrefix(key, "X-Google-Rpc-")
+}
+
+// encodeCall returns the body of the service bridge request for a call
+// to service.method with the encoded request message data.
+func (c *context) encodeCall(ctx netcontext.Context, service, method string, data []byte, opts *CallOptions) (io.ReadCloser, int, error) {
+	req := &remotepb.Request{}
+	if !opts.OmitTicket {
+		ticket, err := c.callTicket(ctx, opts)
+		if err != nil {
+			return nil, 0, err
+		}
+		req.RequestId = &ticket
+	}
+	req.ServiceName = &service
+	req.Method = &method
+	req.Request = data
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), len(b), nil
+}
+
+// callTicket returns the security ticket for a call made with ctx and opts.
+func (c *context) callTicket(ctx netcontext.Context, opts *CallOptions) (string, error) {
+	if opts.Ticket != "" {
+		// The caller's ticket stands in for the request's, without fallbacks.
+		ticket := normalizeTicket(opts.Ticket)
+		if ticket == "" {
+			return "", &CallError{
+				Detail: "invalid ticket: blank",
+				Code:   int32(remotepb.RpcError_BAD_REQUEST),
+			}
+		}
+		return ticket, nil
+	}
+
 	ticket := c.req.Header.Get(ticketHeader)
 	// Use a test ticket under test environment.
 	if ticket == "" {
@@ -498,26 +1478,27 @@ func Call(ctx netcontext.Context, service, method string, in, out proto.Message)
 	if dri := c.req.Header.Get(devRequestIdHeader); IsDevAppServer() && dri != "" {
 		ticket = dri
 	}
-	req := &remotepb.Request{
-		ServiceName: &service,
-		Method:      &method,
-		Request:     data,
-		RequestId:   &ticket,
-	}
-	hreqBody, err := proto.Marshal(req)
-	if err != nil {
-		return err
+	if t := normalizeTicket(ticket); t != ticket {
+		// The ticket is a secret, so only its length is logged.
+		callLogf(ctx, c, 0, "API ticket was malformed (%d bytes); normalized it to %d bytes", len(ticket), len(t)) // debug level
+		ticket = t
 	}
+	return ticket, nil
+}
 
-	hrespBody, err := c.post(hreqBody, timeout)
-	if err != nil {
-		return err
+// acceptedCode reports whether code is one of codes.
+func acceptedCode(codes []int32, code int32) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
 	}
+	return false
+}
 
-	res := &remotepb.Response{}
-	if err := proto.Unmarshal(hrespBody, res); err != nil {
-		return err
-	}
+// responseError returns the error reported by a service bridge response
+// to a call to service, or nil if it reports none.
+func responseError(service string, res *remotepb.Response) error {
 	if res.RpcError != nil {
 		ce := &CallError{
 			Detail: res.RpcError.GetDetail(),
@@ -531,7 +1512,7 @@ func Call(ctx netcontext.Context, service, method string, in, out proto.Message)
 	}
 	if res.ApplicationError != nil {
 		return &APIError{
-			Service: *req.ServiceName,
+			Service: service,
 			Detail:  res.ApplicationError.GetDetail(),
 			Code:    *res.ApplicationError.Code,
 		}
@@ -543,27 +1524,174 @@ func Call(ctx netcontext.Context, service, method string, in, out proto.Message)
 			Code:   int32(remotepb.RpcError_UNKNOWN),
 		}
 	}
-	return proto.Unmarshal(res.Response, out)
+	return nil
 }
 
 func (c *context) Request() *http.Request {
 	return c.req
 }
 
-func (c *context) addLogLine(ll *logpb.UserAppLogLine) {
+// RecordSoftError records a failure that the request could carry on without,
+// such as a failed optional call. All the recorded errors are logged together
+// when the request finishes.
+func (c *context) RecordSoftError(err error) {
+	if c.parent != nil {
+		c.parent.RecordSoftError(err)
+		return
+	}
+	c.softErrors.Lock()
+	c.softErrors.errs = append(c.softErrors.errs, err)
+	c.softErrors.Unlock()
+}
+
+// SoftErrors returns the errors recorded with RecordSoftError.
+func (c *context) SoftErrors() []error {
+	if c.parent != nil {
+		return c.parent.SoftErrors()
+	}
+	c.softErrors.Lock()
+	defer c.softErrors.Unlock()
+	return append([]error(nil), c.softErrors.errs...)
+}
+
+// ChildContext returns a context for work fanned out from c, such as in a
+// goroutine. Calls made with the child carry c's ticket and trace information,
+// and must finish within d or the time remaining to c, whichever is sooner.
+// Logs written to the child are flushed along with c's logs.
+func (c *context) ChildContext(d time.Duration) *context {
+	deadline := time.Now().Add(d)
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline = c.deadline
+	}
+	return c.child(deadline)
+}
+
+// child returns a context derived from c whose calls must finish by deadline,
+// or without a deadline of its own if it is zero.
+func (c *context) child(deadline time.Time) *context {
+	root := c
+	if c.parent != nil {
+		root = c.parent
+	}
+	return &context{
+		req:         c.req,
+		apiURL:      c.apiURL,
+		experiments: c.experiments,
+		authContext: c.authContext,
+		cron:        c.cron,
+		taskInfo:    c.taskInfo,
+		apiVersion:  c.apiVersion,
+		deadline:    deadline,
+		parent:      root,
+
+		defaultVersionHostname: c.defaultVersionHostname,
+		traceSampled:           c.traceSampled,
+		peerIdentity:           c.peerIdentity,
+	}
+}
+
+// HasTicket reports whether the inbound request carried a security ticket.
+func (c *context) HasTicket() bool {
+	return c.req.Header.Get(ticketHeader) != ""
+}
+
+// TicketFingerprint returns a short hash of the inbound security ticket,
+// or the empty string if there is none. It can be logged to correlate
+// ticket problems without revealing the ticket itself.
+func (c *context) TicketFingerprint() string {
+	ticket := c.req.Header.Get(ticketHeader)
+	if ticket == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:4])
+}
+
+// PrepareOutbound sets headers on req, a request to another service made
+// while serving c's request, that carry c's trace context, request ID and
+// remaining time budget, so that the service can continue the trace and
+// give up when c's request would. Headers with no value to carry are left alone.
+func (c *context) PrepareOutbound(req *http.Request) {
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	for _, key := range []string{traceHeader, dapperHeader, hRequestLogId} {
+		if v := c.req.Header.Get(key); v != "" {
+			req.Header.Set(key, v)
+		}
+	}
+	if !c.deadline.IsZero() {
+		ms := time.Until(c.deadline) / time.Millisecond
+		if ms < 1 {
+			ms = 1 // the budget is spent; leave the service no time either
+		}
+		req.Header.Set(timeoutHeader, strconv.FormatInt(int64(ms), 10))
+	}
+}
+
+func (c *context) addLogLines(lls ...*logpb.UserAppLogLine) {
+	if c.parent != nil {
+		c.parent.addLogLines(lls...)
+		return
+	}
+
 	// Truncate long log lines.
 	// TODO(dsymonds): Check if this is still necessary.
 	const lim = 8 << 10
-	if len(*ll.Message) > lim {
-		suffix := fmt.Sprintf("...(length %d)", len(*ll.Message))
-		ll.Message = proto.String((*ll.Message)[:lim-len(suffix)] + suffix)
+	for _, ll := range lls {
+		if len(*ll.Message) > lim {
+			suffix := fmt.Sprintf("...(length %d)", len(*ll.Message))
+			ll.Message = proto.String((*ll.Message)[:lim-len(suffix)] + suffix)
+		}
 	}
 
 	c.pendingLogs.Lock()
-	c.pendingLogs.lines = append(c.pendingLogs.lines, ll)
+	c.pendingLogs.lines = append(c.pendingLogs.lines, lls...)
+	c.trimPendingLogs()
 	c.pendingLogs.Unlock()
 }
 
+// trimPendingLogs drops the oldest buffered log lines beyond the limit set
+// by SetMaxBufferedLogs, rather than let a runaway logger exhaust memory.
+// c.pendingLogs must be locked.
+func (c *context) trimPendingLogs() {
+	max := int(atomic.LoadInt32(&maxBufferedLogs))
+	if max <= 0 {
+		return
+	}
+	if n := len(c.pendingLogs.lines) - max; n > 0 {
+		for i := range c.pendingLogs.lines[:n] {
+			c.pendingLogs.lines[i] = nil
+		}
+		c.pendingLogs.lines = c.pendingLogs.lines[n:]
+		c.pendingLogs.dropped += n
+	}
+}
+
+// maxBufferedLogs is the most log lines a context buffers between flushes,
+// or unlimited if not positive.
+var maxBufferedLogs int32 = 10000 // atomic
+
+// SetMaxBufferedLogs sets the most log lines a context buffers between flushes.
+// When the limit is exceeded the oldest lines are dropped, and the number
+// dropped is reported in the X-AppEngine-Log-Truncated-Count response header.
+// The limit is 10000 lines by default; n <= 0 removes it.
+func SetMaxBufferedLogs(n int) {
+	atomic.StoreInt32(&maxBufferedLogs, int32(n))
+}
+
+// flushTimeout, if positive, limits how long a log flush may take.
+var flushTimeout int64 // atomic; a time.Duration
+
+// SetFlushTimeout limits how long each log flush may take, so that a stuck
+// log service can't hold up the flushing goroutine. The lines of a flush
+// that times out are dropped rather than retried, as the log service may
+// have received them, and are counted as other dropped lines are.
+// A d of zero or less removes the limit beyond that of any API call.
+func SetFlushTimeout(d time.Duration) {
+	atomic.StoreInt64(&flushTimeout, int64(d))
+}
+
 var logLevelName = map[int64]string{
 	0: "DEBUG",
 	1: "INFO",
@@ -573,13 +1701,30 @@ var logLevelName = map[int64]string{
 }
 
 func logf(c *context, level int64, format string, args ...interface{}) {
+	logfAt(c, time.Now(), level, format, args...)
+}
+
+// callLogf is like logf, for the lines logged about a call made with ctx,
+// which are tagged as Logf tags them if the call correlates its logs.
+func callLogf(ctx netcontext.Context, c *context, level int64, format string, args ...interface{}) {
+	format, args = tagCallLog(ctx, format, args)
+	logf(c, level, format, args...)
+}
+
+// LogfAt is like Logf, but the log line carries the time t rather than
+// the time it is logged, such as when replaying events.
+func (c *context) LogfAt(t time.Time, level int64, format string, args ...interface{}) {
+	logfAt(c, t, level, format, args...)
+}
+
+func logfAt(c *context, t time.Time, level int64, format string, args ...interface{}) {
 	if c == nil {
 		panic("not an App Engine context")
 	}
 	s := fmt.Sprintf(format, args...)
 	s = strings.TrimRight(s, "\n") // Remove any trailing newline characters.
-	c.addLogLine(&logpb.UserAppLogLine{
-		TimestampUsec: proto.Int64(time.Now().UnixNano() / 1e3),
+	c.addLogLines(&logpb.UserAppLogLine{
+		TimestampUsec: proto.Int64(t.UnixNano() / 1e3),
 		Level:         &level,
 		Message:       &s,
 	})
@@ -587,11 +1732,121 @@ func logf(c *context, level int64, format string, args ...interface{}) {
 	if !IsSecondGen() {
 		log.Print(logLevelName[level] + ": " + s)
 	}
+	writeDevJSON(t, level, s)
+}
+
+// LogRecord is a preformatted log line.
+type LogRecord struct {
+	Time    time.Time // if zero, the time the record is added
+	Level   int64     // 0 (debug) to 4 (critical), as for Logf
+	Message string
+}
+
+// AddLogRecords adds recs to c's buffered logs in one step,
+// so they are flushed together. It is intended for logging libraries
+// that batch their output.
+func (c *context) AddLogRecords(recs []LogRecord) {
+	now := time.Now()
+	lls := make([]*logpb.UserAppLogLine, len(recs))
+	for i, rec := range recs {
+		t := rec.Time
+		if t.IsZero() {
+			t = now
+		}
+		lls[i] = &logpb.UserAppLogLine{
+			TimestampUsec: proto.Int64(t.UnixNano() / 1e3),
+			Level:         proto.Int64(rec.Level),
+			Message:       proto.String(strings.TrimRight(rec.Message, "\n")),
+		}
+		if !IsSecondGen() {
+			log.Print(logLevelName[rec.Level] + ": " + rec.Message)
+		}
+		writeDevJSON(t, rec.Level, lls[i].GetMessage())
+	}
+	c.addLogLines(lls...)
+}
+
+// BufferedLogs returns a copy of the log lines c has buffered but not yet
+// flushed, oldest first.
+func (c *context) BufferedLogs() []LogRecord {
+	if c.parent != nil {
+		return c.parent.BufferedLogs()
+	}
+	c.pendingLogs.Lock()
+	defer c.pendingLogs.Unlock()
+	recs := make([]LogRecord, len(c.pendingLogs.lines))
+	for i, ll := range c.pendingLogs.lines {
+		recs[i] = LogRecord{
+			Time:    time.Unix(0, ll.GetTimestampUsec()*1e3),
+			Level:   ll.GetLevel(),
+			Message: ll.GetMessage(),
+		}
+	}
+	return recs
+}
+
+// AbsorbLogs moves the log lines buffered by other into c's buffer, so that
+// they are flushed together. The combined lines are kept in timestamp order.
+// Contexts created with ChildContext share their parent's buffer already.
+func (c *context) AbsorbLogs(other *context) {
+	if c.parent != nil {
+		c = c.parent
+	}
+	if other.parent != nil {
+		other = other.parent
+	}
+	if other == c {
+		return
+	}
+	other.pendingLogs.Lock()
+	lls := other.pendingLogs.lines
+	other.pendingLogs.lines = nil
+	other.pendingLogs.Unlock()
+	if len(lls) == 0 {
+		return
+	}
+
+	c.addLogLines(lls...)
+	c.pendingLogs.Lock()
+	lines := c.pendingLogs.lines
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].GetTimestampUsec() < lines[j].GetTimestampUsec()
+	})
+	c.pendingLogs.Unlock()
+}
+
+// InfofSync logs at info level and flushes the logs to the appserver
+// before returning. It returns the error if the flush failed, in which
+// case the logs remain buffered for a later flush.
+func (c *context) InfofSync(format string, args ...interface{}) error {
+	logf(c, 1, format, args...)
+	_, err := c.flushLog(false)
+	return err
+}
+
+// ErrorfSync is like InfofSync but logs at error level.
+func (c *context) ErrorfSync(format string, args ...interface{}) error {
+	logf(c, 3, format, args...)
+	_, err := c.flushLog(false)
+	return err
+}
+
+// isLogFlush reports whether service.method is the call flushLog makes.
+func isLogFlush(service, method string) bool {
+	return service == "logservice" && method == "Flush"
 }
 
 // flushLog attempts to flush any pending logs to the appserver.
-// It should not be called concurrently.
-func (c *context) flushLog(force bool) (flushed bool) {
+// It reports whether a flush was made, and the error if one failed.
+func (c *context) flushLog(force bool) (flushed bool, err error) {
+	if c.parent != nil {
+		return c.parent.flushLog(force)
+	}
+
+	// Flushes are serialized so rescued logs keep their order.
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
 	c.pendingLogs.Lock()
 	// Grab up to 30 MB. We can get away with up to 32 MB, but let's be cautious.
 	n, rem := 0, 30<<20
@@ -604,13 +1859,16 @@ func (c *context) flushLog(force bool) (flushed bool) {
 		}
 		rem -= nb
 	}
-	lines := c.pendingLogs.lines[:n]
+	// Take a snapshot of the lines to flush. Its capacity is capped so that
+	// rescuing it can't write into the buffer, which keeps taking lines
+	// while the snapshot is sent.
+	lines := c.pendingLogs.lines[:n:n]
 	c.pendingLogs.lines = c.pendingLogs.lines[n:]
 	c.pendingLogs.Unlock()
 
 	if len(lines) == 0 && !force {
 		// Nothing to flush.
-		return false
+		return false, nil
 	}
 
 	rescueLogs := false
@@ -618,6 +1876,7 @@ func (c *context) flushLog(force bool) (flushed bool) {
 		if rescueLogs {
 			c.pendingLogs.Lock()
 			c.pendingLogs.lines = append(lines, c.pendingLogs.lines...)
+			c.trimPendingLogs()
 			c.pendingLogs.Unlock()
 		}
 	}()
@@ -628,7 +1887,7 @@ func (c *context) flushLog(force bool) (flushed bool) {
 	if err != nil {
 		log.Printf("internal.flushLog: marshaling UserAppLogGroup: %v", err)
 		rescueLogs = true
-		return false
+		return false, err
 	}
 
 	req := &logpb.FlushRequest{
@@ -638,12 +1897,36 @@ func (c *context) flushLog(force bool) (flushed bool) {
 	c.pendingLogs.Lock()
 	c.pendingLogs.flushes++
 	c.pendingLogs.Unlock()
-	if err := Call(toContext(c), "logservice", "Flush", req, res); err != nil {
+	ctx := toContext(c)
+	if d := time.Duration(atomic.LoadInt64(&flushTimeout)); d > 0 {
+		ctx = WithCallOptions(ctx, &CallOptions{Timeout: d})
+	}
+	if err := Call(ctx, "logservice", "Flush", req, res); err != nil {
 		log.Printf("internal.flushLog: Flush RPC: %v", err)
+		if err == errTimeout {
+			c.pendingLogs.Lock()
+			c.pendingLogs.dropped += len(lines)
+			c.pendingLogs.Unlock()
+			return false, err
+		}
 		rescueLogs = true
-		return false
+		return false, err
 	}
-	return true
+	c.pendingLogs.Lock()
+	c.pendingLogs.lastFlush = time.Now()
+	c.pendingLogs.Unlock()
+	return true, nil
+}
+
+// LastFlushTime returns when the logs of c were last flushed successfully.
+// It returns false if they never have been.
+func (c *context) LastFlushTime() (time.Time, bool) {
+	if c.parent != nil {
+		return c.parent.LastFlushTime()
+	}
+	c.pendingLogs.Lock()
+	defer c.pendingLogs.Unlock()
+	return c.pendingLogs.lastFlush, !c.pendingLogs.lastFlush.IsZero()
 }
 
 const (
@@ -663,7 +1946,7 @@ func (c *context) logFlusher(stop <-chan int) {
 			return
 		case <-tick.C:
 			force := time.Now().Sub(lastFlush) > forceFlushInterval
-			if c.flushLog(force) {
+			if flushed, _ := c.flushLog(force); flushed {
 				lastFlush = time.Now()
 			}
 		}
@@ -77,7 +77,33 @@ func FullyQualifiedAppID(ctx netcontext.Context) string {
 	return fullyQualifiedAppID(ctx)
 }
 
+// callLogTagsKey holds the *callLogTags of the call a context was made for.
+var callLogTagsKey = "holds a *callLogTags"
+
+// callLogTags identify a call in the logs written with its context.
+type callLogTags struct {
+	id, service string
+}
+
+// withCallLogTags returns a copy of ctx with which logs are tagged with the
+// call ID and service. The tags go wherever the returned context goes, and
+// no further, so they can't outlive the call or leak to other calls.
+func withCallLogTags(ctx netcontext.Context, id, service string) netcontext.Context {
+	return netcontext.WithValue(ctx, &callLogTagsKey, &callLogTags{id, service})
+}
+
+// tagCallLog adds the tags of the call ctx was made for, if any,
+// to a log line's format and args.
+func tagCallLog(ctx netcontext.Context, format string, args []interface{}) (string, []interface{}) {
+	if t, ok := ctx.Value(&callLogTagsKey).(*callLogTags); ok {
+		format += " [call=%s service=%s]"
+		args = append(args[:len(args):len(args)], t.id, t.service)
+	}
+	return format, args
+}
+
 func Logf(ctx netcontext.Context, level int64, format string, args ...interface{}) {
+	format, args = tagCallLog(ctx, format, args)
 	if f, ok := ctx.Value(&logOverrideKey).(logOverrideFunc); ok {
 		f(level, format, args...)
 		return
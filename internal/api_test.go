@@ -9,15 +9,23 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
+	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -26,6 +34,7 @@ import (
 	netcontext "golang.org/x/net/context"
 
 	basepb "google.golang.org/appengine/internal/base"
+	logpb "google.golang.org/appengine/internal/log"
 	remotepb "google.golang.org/appengine/internal/remote_api"
 )
 
@@ -39,19 +48,117 @@ type fakeAPIHandler struct {
 	hang chan int // used for RunSlowly RPC
 
 	LogFlushes int32 // atomic
+	Requests   int32 // atomic; number of API requests received
+	FlakyCalls int32 // atomic; number of flaky.Value requests received
+	Counter    int32 // atomic; incremented by counter.Incr requests
+
+	dropResponses int32 // atomic; number of responses yet to be lost in transit
+
+	delayInFlight    int32 // atomic; number of delay.Respond requests being served
+	delayMaxInFlight int32 // atomic; the most delay.Respond requests served at once
+
+	mu        sync.Mutex
+	headers   map[string]http.Header        // last request headers received, by "service.method"
+	flushed   [][]string                    // messages of the log lines in each flush
+	flushedAt map[string]int64              // timestamp of the last flushed log line with each message
+	rpcErrors map[string]*remotepb.RpcError // canned errors, by "service.method"
+
+	lastTicket    string        // security ticket of the last call received
+	lastRequestID *string       // the ticket field of the last call received, nil if unset
+	handled       []handledCall // calls received, in order
+}
+
+// handledCall is a call received by the fake.
+type handledCall struct {
+	callID          string // as sent by the client
+	service, method string
+	request         []byte // the encoded request message
+}
+
+// respondWithRPCError makes the fake API server answer calls to
+// service.method with an RpcError with the given code and detail.
+func (f *fakeAPIHandler) respondWithRPCError(service, method string, code remotepb.RpcError_ErrorCode, detail string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rpcErrors == nil {
+		f.rpcErrors = make(map[string]*remotepb.RpcError)
+	}
+	f.rpcErrors[service+"."+method] = &remotepb.RpcError{
+		Code:   proto.Int32(int32(code)),
+		Detail: proto.String(detail),
+	}
+}
+
+func (f *fakeAPIHandler) lastHeader(service, method, key string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.headers[service+"."+method].Get(key)
+}
+
+// handledCalls returns the calls received so far, in the order of receipt.
+func (f *fakeAPIHandler) handledCalls() []handledCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]handledCall(nil), f.handled...)
+}
+
+func (f *fakeAPIHandler) flushedLogs() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]string(nil), f.flushed...)
+}
+
+// flushedTime returns the timestamp of the last flushed log line with
+// message msg, and whether there was one.
+func (f *fakeAPIHandler) flushedTime(msg string) (time.Time, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	usec, ok := f.flushedAt[msg]
+	return time.Unix(0, usec*1e3), ok
+}
+
+func (f *fakeAPIHandler) lastDeadlineHeader(service, method string) string {
+	return f.lastHeader(service, method, apiDeadlineHeader)
+}
+
+// LastDeadline returns the deadline forwarded with the last call to
+// service.method. It reports false if there was no such call, or if
+// it carried no valid deadline.
+func (f *fakeAPIHandler) LastDeadline(service, method string) (time.Duration, bool) {
+	secs, err := strconv.ParseFloat(f.lastDeadlineHeader(service, method), 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
 }
 
 func (f *fakeAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var gzipResponse bool      // compress the response, without saying so
+	var contentEncoding string // encode the response, and say so
 	writeResponse := func(res *remotepb.Response) {
 		hresBody, err := proto.Marshal(res)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed encoding API response: %v", err), 500)
 			return
 		}
-		w.Write(hresBody)
+		if contentEncoding != "" {
+			w.Header().Set("Content-Encoding", contentEncoding)
+		}
+		var zw io.WriteCloser
+		switch {
+		case gzipResponse || contentEncoding == "gzip":
+			zw = gzip.NewWriter(w)
+		case contentEncoding == "deflate":
+			zw = zlib.NewWriter(w)
+		default:
+			w.Write(hresBody)
+			return
+		}
+		zw.Write(hresBody)
+		zw.Close()
 	}
 
-	if r.URL.Path != "/rpc_http" {
+	if r.URL.Path != "/rpc_http" && r.URL.Path != altAPIPath {
 		http.NotFound(w, r)
 		return
 	}
@@ -65,7 +172,13 @@ func (f *fakeAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Bad encoded API request: %v", err), 500)
 		return
 	}
-	if *apiReq.RequestId != "s3cr3t" && *apiReq.RequestId != DefaultTicket() {
+	atomic.AddInt32(&f.Requests, 1)
+	f.mu.Lock()
+	f.lastTicket = apiReq.GetRequestId()
+	f.lastRequestID = apiReq.RequestId
+	f.mu.Unlock()
+	// Calls without a ticket are taken to be to services that don't need one.
+	if apiReq.RequestId != nil && *apiReq.RequestId != "s3cr3t" && *apiReq.RequestId != DefaultTicket() {
 		writeResponse(&remotepb.Response{
 			RpcError: &remotepb.RpcError{
 				Code:   proto.Int32(int32(remotepb.RpcError_SECURITY_VIOLATION)),
@@ -85,8 +198,29 @@ func (f *fakeAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	service, method := *apiReq.ServiceName, *apiReq.Method
+	// Tag the response with the call it answers.
+	callID := r.Header.Get(apiCallIDHeader)
+	w.Header().Set(apiCallIDHeader, callID)
+	f.mu.Lock()
+	f.handled = append(f.handled, handledCall{callID, service, method, apiReq.Request})
+	if f.headers == nil {
+		f.headers = make(map[string]http.Header)
+	}
+	f.headers[service+"."+method] = r.Header
+	rpcErr := f.rpcErrors[service+"."+method]
+	f.mu.Unlock()
+	if rpcErr != nil {
+		writeResponse(&remotepb.Response{
+			RpcError: rpcErr,
+		})
+		return
+	}
 	var resOut proto.Message
 	if service == "actordb" && method == "LookupActor" {
+		if r.Header.Get(apiIfNoneMatchHeader) == "tennant-v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
 		req := &basepb.StringProto{}
 		res := &basepb.StringProto{}
 		if err := proto.Unmarshal(apiReq.Request, req); err != nil {
@@ -103,10 +237,43 @@ func (f *fakeAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case "Non200":
 			http.Error(w, "I'm a little teapot.", 418)
 			return
+		case "Redirect":
+			http.Redirect(w, r, "/moved", http.StatusFound)
+			return
 		case "ShortResponse":
 			w.Header().Set("Content-Length", "100")
 			w.Write([]byte("way too short"))
 			return
+		case "ConnReset":
+			// Send part of the response, then reset the connection
+			// while the client waits for the rest.
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				panic(fmt.Sprintf("Hijack: %v", err))
+			}
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nway too short")
+			buf.Flush()
+			time.Sleep(50 * time.Millisecond)
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			return
+		case "TrailerError":
+			// Send a good looking response, then report an error in the trailers.
+			w.Header().Set("Trailer", apiErrorCodeTrailer+", "+apiErrorDetailTrailer)
+			writeResponse(&remotepb.Response{
+				Response: []byte{},
+			})
+			w.Header().Set(apiErrorCodeTrailer, strconv.Itoa(int(remotepb.RpcError_CAPABILITY_DISABLED)))
+			w.Header().Set(apiErrorDetailTrailer, "backend went away mid-stream")
+			return
+		case "ApplicationError":
+			writeResponse(&remotepb.Response{
+				ApplicationError: &remotepb.ApplicationError{
+					Code:   proto.Int32(3),
+					Detail: proto.String("no such widget"),
+				},
+			})
+			return
 		case "OverQuota":
 			writeResponse(&remotepb.Response{
 				RpcError: &remotepb.RpcError{
@@ -124,7 +291,99 @@ func (f *fakeAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			resOut = &basepb.VoidProto{}
 		}
 	}
+	if service == "echo" && method == "Echo" {
+		req := &basepb.StringProto{}
+		if err := proto.Unmarshal(apiReq.Request, req); err != nil {
+			http.Error(w, fmt.Sprintf("Bad encoded request: %v", err), 500)
+			return
+		}
+		resOut = req
+	}
+	if service == "encoding" {
+		// Echo the request, encoded as named by the method.
+		contentEncoding = method
+		req := &basepb.StringProto{}
+		if err := proto.Unmarshal(apiReq.Request, req); err != nil {
+			http.Error(w, fmt.Sprintf("Bad encoded request: %v", err), 500)
+			return
+		}
+		resOut = req
+	}
+	if service == "gzip" && method == "Echo" {
+		gzipResponse = true
+		req := &basepb.StringProto{}
+		if err := proto.Unmarshal(apiReq.Request, req); err != nil {
+			http.Error(w, fmt.Sprintf("Bad encoded request: %v", err), 500)
+			return
+		}
+		resOut = req
+	}
+	if service == "empty" && method == "Respond" {
+		writeResponse(&remotepb.Response{
+			Response: []byte{},
+		})
+		return
+	}
+	if service == "blob" && method == "Read" {
+		req := &basepb.Integer32Proto{}
+		if err := proto.Unmarshal(apiReq.Request, req); err != nil {
+			http.Error(w, fmt.Sprintf("Bad encoded request: %v", err), 500)
+			return
+		}
+		resOut = &basepb.BytesProto{Value: blobBytes(int(req.GetValue()))}
+	}
+	if service == "delay" && method == "Respond" {
+		n := atomic.AddInt32(&f.delayInFlight, 1)
+		for {
+			max := atomic.LoadInt32(&f.delayMaxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&f.delayMaxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&f.delayInFlight, -1)
+		resOut = &basepb.VoidProto{}
+	}
+	if service == "flaky" && method == "Value" {
+		// The first response is empty; later ones are not.
+		res := &basepb.StringProto{Value: proto.String("")}
+		if atomic.AddInt32(&f.FlakyCalls, 1) > 1 {
+			res.Value = proto.String("steady")
+		}
+		resOut = res
+	}
+	if service == "counter" && method == "Incr" {
+		resOut = &basepb.Integer32Proto{Value: proto.Int32(atomic.AddInt32(&f.Counter, 1))}
+	}
+	if service == "attachments" && method == "Echo" {
+		w.Header().Set(apiAttachmentHeader, r.Header.Get(apiAttachmentHeader))
+		resOut = &basepb.VoidProto{}
+	}
 	if service == "logservice" && method == "Flush" {
+		req := &logpb.FlushRequest{}
+		group := &logpb.UserAppLogGroup{}
+		if err := proto.Unmarshal(apiReq.Request, req); err != nil {
+			http.Error(w, fmt.Sprintf("Bad encoded request: %v", err), 500)
+			return
+		}
+		if err := proto.Unmarshal(req.Logs, group); err != nil {
+			http.Error(w, fmt.Sprintf("Bad encoded log group: %v", err), 500)
+			return
+		}
+		var msgs []string
+		for _, ll := range group.LogLine {
+			msgs = append(msgs, ll.GetMessage())
+		}
+		f.mu.Lock()
+		f.flushed = append(f.flushed, msgs)
+		if f.flushedAt == nil {
+			f.flushedAt = make(map[string]int64)
+		}
+		for _, ll := range group.LogLine {
+			f.flushedAt[ll.GetMessage()] = ll.GetTimestampUsec()
+		}
+		f.mu.Unlock()
+
 		// Pretend log flushing is slow.
 		time.Sleep(50 * time.Millisecond)
 		atomic.AddInt32(&f.LogFlushes, 1)
@@ -136,6 +395,15 @@ func (f *fakeAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, fmt.Sprintf("Failed encoding response: %v", err), 500)
 		return
 	}
+	if atomic.LoadInt32(&f.dropResponses) > 0 && atomic.AddInt32(&f.dropResponses, -1) >= 0 {
+		// Lose the response: close the connection without sending it.
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			panic(fmt.Sprintf("Hijack: %v", err))
+		}
+		conn.Close()
+		return
+	}
 	writeResponse(&remotepb.Response{
 		Response: encOut,
 	})
@@ -196,137 +464,2460 @@ func TestAPICallTicketUnavailable(t *testing.T) {
 	}
 }
 
-func TestAPICallRPCFailure(t *testing.T) {
+func TestAPICallIdempotencyKey(t *testing.T) {
 	f, c, cleanup := setup()
 	defer cleanup()
 
-	testCases := []struct {
-		method string
-		code   remotepb.RpcError_ErrorCode
-	}{
-		{"Non200", remotepb.RpcError_UNKNOWN},
-		{"ShortResponse", remotepb.RpcError_UNKNOWN},
-		{"OverQuota", remotepb.RpcError_OVER_QUOTA},
-		{"RunSlowly", remotepb.RpcError_CANCELLED},
+	ctx := WithCallOptions(toContext(c), &CallOptions{IdempotencyKey: "incr-1"})
+	req := &basepb.VoidProto{}
+	res := &basepb.Integer32Proto{}
+	if err := Call(ctx, "counter", "Incr", req, res); err != nil {
+		t.Fatalf("API call failed: %v", err)
 	}
-	f.hang = make(chan int) // only for RunSlowly
-	for _, tc := range testCases {
-		ctx, _ := netcontext.WithTimeout(toContext(c), 100*time.Millisecond)
-		err := Call(ctx, "errors", tc.method, &basepb.VoidProto{}, &basepb.VoidProto{})
-		ce, ok := err.(*CallError)
-		if !ok {
-			t.Errorf("%s: API call error is %T (%v), want *CallError", tc.method, err, err)
-			continue
-		}
-		if ce.Code != int32(tc.code) {
-			t.Errorf("%s: ce.Code = %d, want %d", tc.method, ce.Code, tc.code)
-		}
-		if tc.method == "RunSlowly" {
-			f.hang <- 1 // release the HTTP handler
-		}
+
+	// Repeating the call should be answered without reaching the server.
+	res.Reset()
+	if err := Call(ctx, "counter", "Incr", req, res); err != nil {
+		t.Fatalf("Repeated API call failed: %v", err)
+	}
+	if got, want := res.GetValue(), int32(1); got != want {
+		t.Errorf("Response is %d, want %d", got, want)
+	}
+	if got, want := atomic.LoadInt32(&f.Counter), int32(1); got != want {
+		t.Errorf("Counter is %d, want %d", got, want)
+	}
+
+	// Reusing the key for a different request should fail.
+	ctx = WithCallOptions(toContext(c), &CallOptions{IdempotencyKey: "lookup-who-1"})
+	if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who II")}, &basepb.StringProto{})
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_BAD_REQUEST) {
+		t.Errorf("Call with a reused key = %v, want a BAD_REQUEST *CallError", err)
+	}
+	if got, want := atomic.LoadInt32(&f.Requests), int32(2); got != want {
+		t.Errorf("Server received %d requests, want %d", got, want)
+	}
+
+	// Only successful calls are recorded, so a retry of a call whose
+	// response was lost is dispatched again, and takes effect again.
+	ctx = WithCallOptions(toContext(c), &CallOptions{IdempotencyKey: "incr-2", Retries: 1})
+	atomic.StoreInt32(&f.dropResponses, 1)
+	if err := Call(ctx, "counter", "Incr", req, res); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got, want := atomic.LoadInt32(&f.Counter), int32(3); got != want {
+		t.Errorf("Counter is %d, want %d", got, want)
 	}
 }
 
-func TestAPICallDialFailure(t *testing.T) {
-	// See what happens if the API host is unresponsive.
-	// This should time out quickly, not hang forever.
-	_, c, cleanup := setup()
+func TestServiceClassDeadline(t *testing.T) {
+	f, c, cleanup := setup()
 	defer cleanup()
-	// Reset the URL to the production address so that dialing fails.
-	c.apiURL = apiURL()
 
-	start := time.Now()
-	err := Call(toContext(c), "foo", "bar", &basepb.VoidProto{}, &basepb.VoidProto{})
-	const max = 1 * time.Second
-	if taken := time.Since(start); taken > max {
-		t.Errorf("Dial hang took too long: %v > %v", taken, max)
+	SetServiceClass("actordb", ServiceClassBatch)
+	defer func() {
+		serviceClasses.Lock()
+		delete(serviceClasses.m, "actordb")
+		serviceClasses.Unlock()
+	}()
+
+	req := &basepb.StringProto{
+		Value: proto.String("Doctor Who"),
 	}
-	if err == nil {
-		t.Error("Call did not fail")
+	if err := Call(toContext(c), "actordb", "LookupActor", req, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got, want := f.lastDeadlineHeader("actordb", "LookupActor"), "600"; got != want {
+		t.Errorf("Forwarded deadline for batch service = %q, want %q", got, want)
+	}
+
+	// Unclassified services keep the default timeout.
+	if err := Call(toContext(c), "attachments", "Echo", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got, want := f.lastDeadlineHeader("attachments", "Echo"), "60"; got != want {
+		t.Errorf("Forwarded deadline for unclassified service = %q, want %q", got, want)
+	}
+
+	// An interactive service is capped even when the context allows longer.
+	SetServiceClass("actordb", ServiceClassInteractive)
+	ctx, cancel := netcontext.WithTimeout(toContext(c), time.Minute)
+	defer cancel()
+	if err := Call(ctx, "actordb", "LookupActor", req, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got, want := f.lastDeadlineHeader("actordb", "LookupActor"), "5"; got != want {
+		t.Errorf("Forwarded deadline for interactive service = %q, want %q", got, want)
 	}
 }
 
-func TestDelayedLogFlushing(t *testing.T) {
+func TestChildContextDeadline(t *testing.T) {
 	f, c, cleanup := setup()
 	defer cleanup()
 
-	http.HandleFunc("/slow_log", func(w http.ResponseWriter, r *http.Request) {
-		logC := WithContext(netcontext.Background(), r)
-		fromContext(logC).apiURL = c.apiURL // Otherwise it will try to use the default URL.
-		Logf(logC, 1, "It's a lovely day.")
-		w.WriteHeader(200)
-		time.Sleep(1200 * time.Millisecond)
-		w.Write(make([]byte, 100<<10)) // write 100 KB to force HTTP flush
-	})
+	c.deadline = time.Now().Add(200 * time.Millisecond)
+	child := c.ChildContext(time.Hour)
+	if child.deadline.After(c.deadline) {
+		t.Errorf("Child deadline %v is after parent deadline %v", child.deadline, c.deadline)
+	}
+	if short := c.ChildContext(time.Millisecond); !short.deadline.Before(c.deadline) {
+		t.Errorf("Child deadline %v is not before parent deadline %v", short.deadline, c.deadline)
+	}
 
-	r := &http.Request{
-		Method: "GET",
-		URL: &url.URL{
-			Scheme: "http",
-			Path:   "/slow_log",
-		},
-		Header: c.req.Header,
-		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+	req := &basepb.StringProto{
+		Value: proto.String("Doctor Who"),
+	}
+	res := &basepb.StringProto{}
+	if err := Call(toContext(child), "actordb", "LookupActor", req, res); err != nil {
+		t.Fatalf("API call with child context failed: %v", err)
+	}
+	hdr := f.lastDeadlineHeader("actordb", "LookupActor")
+	if secs, err := strconv.ParseFloat(hdr, 64); err != nil || secs > 0.2 {
+		t.Errorf("Forwarded deadline = %q, want at most 0.2", hdr)
 	}
-	w := httptest.NewRecorder()
 
-	handled := make(chan struct{})
-	go func() {
-		defer close(handled)
-		handleHTTP(w, r)
-	}()
-	// Check that the log flush eventually comes in.
-	time.Sleep(1200 * time.Millisecond)
-	if f := atomic.LoadInt32(&f.LogFlushes); f != 1 {
-		t.Errorf("After 1.2s: f.LogFlushes = %d, want 1", f)
+	logf(child, 1, "from a goroutine")
+	c.pendingLogs.Lock()
+	n := len(c.pendingLogs.lines)
+	c.pendingLogs.Unlock()
+	if n != 1 {
+		t.Errorf("Parent has %d pending log lines after child logged, want 1", n)
 	}
+}
 
-	<-handled
-	const hdr = "X-AppEngine-Log-Flush-Count"
-	if got, want := w.HeaderMap.Get(hdr), "1"; got != want {
-		t.Errorf("%s header = %q, want %q", hdr, got, want)
+func TestEffectiveDeadline(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	SetServiceClass("actordb", ServiceClassInteractive) // 5s
+	defer func() {
+		serviceClasses.Lock()
+		delete(serviceClasses.m, "actordb")
+		serviceClasses.Unlock()
+	}()
+
+	near := func(got time.Time, want time.Duration) bool {
+		d := got.Sub(time.Now()) - want
+		return -time.Second < d && d <= 0
 	}
-	if got, want := atomic.LoadInt32(&f.LogFlushes), int32(2); got != want {
-		t.Errorf("After HTTP response: f.LogFlushes = %d, want %d", got, want)
+	opts := &CallOptions{Timeout: 3 * time.Second}
+	c.deadline = time.Now().Add(2 * time.Second)
+	if got := c.EffectiveDeadline("actordb", "LookupActor", opts); !near(got, 2*time.Second) {
+		t.Errorf("With context deadline: EffectiveDeadline = %v from now, want 2s", got.Sub(time.Now()))
+	}
+	c.deadline = time.Time{}
+	if got := c.EffectiveDeadline("actordb", "LookupActor", opts); !near(got, 3*time.Second) {
+		t.Errorf("With call timeout: EffectiveDeadline = %v from now, want 3s", got.Sub(time.Now()))
+	}
+	if got := c.EffectiveDeadline("actordb", "LookupActor", nil); !near(got, 5*time.Second) {
+		t.Errorf("With service class: EffectiveDeadline = %v from now, want 5s", got.Sub(time.Now()))
+	}
+	if got := c.EffectiveDeadline("attachments", "Echo", nil); !near(got, 60*time.Second) {
+		t.Errorf("With defaults: EffectiveDeadline = %v from now, want 60s", got.Sub(time.Now()))
 	}
 
+	fixed := time.Now().Add(42 * time.Second)
+	SetDeadlineOverride(func(service, method string, deadline time.Time) time.Time {
+		return fixed
+	})
+	defer SetDeadlineOverride(nil)
+	if got := c.EffectiveDeadline("actordb", "LookupActor", opts); !got.Equal(fixed) {
+		t.Errorf("With override: EffectiveDeadline = %v, want %v", got, fixed)
+	}
 }
 
-func TestLogFlushing(t *testing.T) {
-	f, c, cleanup := setup()
+func TestAPICallAttachment(t *testing.T) {
+	_, c, cleanup := setup()
 	defer cleanup()
 
-	http.HandleFunc("/quick_log", func(w http.ResponseWriter, r *http.Request) {
-		logC := WithContext(netcontext.Background(), r)
-		fromContext(logC).apiURL = c.apiURL // Otherwise it will try to use the default URL.
-		Logf(logC, 1, "It's a lovely day.")
-		w.WriteHeader(200)
-		w.Write(make([]byte, 100<<10)) // write 100 KB to force HTTP flush
+	var got []byte
+	att := []byte("\x00binary\xffblob")
+	ctx := WithCallOptions(toContext(c), &CallOptions{
+		Attachment:         att,
+		ResponseAttachment: &got,
 	})
+	if err := Call(ctx, "attachments", "Echo", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if !bytes.Equal(got, att) {
+		t.Errorf("Response attachment is %q, want %q", got, att)
+	}
+}
 
-	r := &http.Request{
-		Method: "GET",
-		URL: &url.URL{
-			Scheme: "http",
-			Path:   "/quick_log",
-		},
-		Header: c.req.Header,
-		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+func TestDeterministicMarshal(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	req := &basepb.StringProto{
+		Value: proto.String("Doctor Who"),
+	}
+	b1, err := marshalRequest(req, true)
+	if err != nil {
+		t.Fatalf("marshalRequest: %v", err)
+	}
+	b2, err := marshalRequest(proto.Clone(req), true)
+	if err != nil {
+		t.Fatalf("marshalRequest: %v", err)
+	}
+	if !bytes.Equal(b1, b2) {
+		t.Errorf("Deterministic marshals differ: %x vs %x", b1, b2)
 	}
-	w := httptest.NewRecorder()
 
-	handleHTTP(w, r)
-	const hdr = "X-AppEngine-Log-Flush-Count"
-	if got, want := w.HeaderMap.Get(hdr), "1"; got != want {
-		t.Errorf("%s header = %q, want %q", hdr, got, want)
+	res := &basepb.StringProto{}
+	ctx := WithCallOptions(toContext(c), &CallOptions{Deterministic: true})
+	if err := Call(ctx, "actordb", "LookupActor", req, res); err != nil {
+		t.Fatalf("API call failed: %v", err)
 	}
-	if got, want := atomic.LoadInt32(&f.LogFlushes), int32(1); got != want {
-		t.Errorf("After HTTP response: f.LogFlushes = %d, want %d", got, want)
+	if got, want := res.GetValue(), "David Tennant"; got != want {
+		t.Errorf("Response is %q, want %q", got, want)
 	}
 }
 
-func TestRemoteAddr(t *testing.T) {
-	var addr string
+func TestAPICallMarshalFailure(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	// StringProto's value is required.
+	for _, deterministic := range []bool{false, true} {
+		before := atomic.LoadInt32(&f.Requests)
+		ctx := WithCallOptions(toContext(c), &CallOptions{Deterministic: deterministic})
+		err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{}, &basepb.StringProto{})
+		ce, ok := err.(*CallError)
+		if !ok || ce.Code != int32(remotepb.RpcError_BAD_REQUEST) {
+			t.Errorf("deterministic=%t: API call with a bad request returned %v, want BAD_REQUEST", deterministic, err)
+			continue
+		}
+		if want := "bad request message *base.StringProto"; !strings.Contains(ce.Detail, want) || !strings.Contains(ce.Detail, "Value") {
+			t.Errorf("deterministic=%t: error detail is %q, want it to name the message and the missing field", deterministic, ce.Detail)
+		}
+		if n := atomic.LoadInt32(&f.Requests) - before; n != 0 {
+			t.Errorf("deterministic=%t: service bridge got %d requests, want none", deterministic, n)
+		}
+	}
+}
+
+// altAPIPath is another path the fake serves API calls at.
+const altAPIPath = "/alt/rpc_http"
+
+func TestSetAPIPath(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	host, port, err := net.SplitHostPort(c.apiURL.Host)
+	if err != nil {
+		t.Fatalf("SplitHostPort(%q): %v", c.apiURL.Host, err)
+	}
+	defer os.Setenv("API_HOST", os.Getenv("API_HOST"))
+	defer os.Setenv("API_PORT", os.Getenv("API_PORT"))
+	os.Setenv("API_HOST", host)
+	os.Setenv("API_PORT", port)
+	defer SetAPIPath("")
+
+	call := func(path string) error {
+		SetAPIPath(path)
+		c.apiURL = apiURL()
+		if got, want := c.apiURL.Path, path; path != "" && got != want {
+			t.Errorf("API URL path is %q, want %q", got, want)
+		}
+		return Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	}
+	if err := call(altAPIPath); err != nil {
+		t.Errorf("API call to %s failed: %v", altAPIPath, err)
+	}
+	if err := call("/nowhere"); err == nil {
+		t.Error("API call to a path the fake doesn't serve succeeded")
+	}
+	if err := call(""); err != nil {
+		t.Errorf("API call to the default path failed: %v", err)
+	}
+}
+
+func TestTicketFingerprint(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	if !c.HasTicket() {
+		t.Error("HasTicket() = false, want true")
+	}
+	fp := c.TicketFingerprint()
+	if len(fp) != 8 {
+		t.Errorf("TicketFingerprint() = %q, want 8 hex digits", fp)
+	}
+	if strings.Contains(fp, "s3cr3t") {
+		t.Errorf("TicketFingerprint() = %q reveals the ticket", fp)
+	}
+	if got := c.TicketFingerprint(); got != fp {
+		t.Errorf("TicketFingerprint() = %q, then %q; want stable", fp, got)
+	}
+
+	c.req.Header.Del(ticketHeader)
+	if c.HasTicket() {
+		t.Error("HasTicket() = true without a ticket, want false")
+	}
+	if got := c.TicketFingerprint(); got != "" {
+		t.Errorf("TicketFingerprint() = %q without a ticket, want empty", got)
+	}
+}
+
+func TestAPICallRPCFailure(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	testCases := []struct {
+		method string
+		code   remotepb.RpcError_ErrorCode
+	}{
+		{"Non200", remotepb.RpcError_UNKNOWN},
+		{"ShortResponse", remotepb.RpcError_UNKNOWN},
+		{"OverQuota", remotepb.RpcError_OVER_QUOTA},
+		{"TrailerError", remotepb.RpcError_CAPABILITY_DISABLED},
+		{"RunSlowly", remotepb.RpcError_CANCELLED},
+	}
+	f.hang = make(chan int) // only for RunSlowly
+	for _, tc := range testCases {
+		ctx, _ := netcontext.WithTimeout(toContext(c), 100*time.Millisecond)
+		err := Call(ctx, "errors", tc.method, &basepb.VoidProto{}, &basepb.VoidProto{})
+		ce, ok := err.(*CallError)
+		if !ok {
+			t.Errorf("%s: API call error is %T (%v), want *CallError", tc.method, err, err)
+			continue
+		}
+		if ce.Code != int32(tc.code) {
+			t.Errorf("%s: ce.Code = %d, want %d", tc.method, ce.Code, tc.code)
+		}
+		if tc.method == "RunSlowly" {
+			f.hang <- 1 // release the HTTP handler
+		}
+	}
+}
+
+func TestAPICallValidateResponse(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	opts := &CallOptions{
+		ValidateResponse: func(out proto.Message) error {
+			if out.(*basepb.StringProto).GetValue() == "" {
+				return errors.New("empty value")
+			}
+			return nil
+		},
+	}
+	ctx := WithCallOptions(toContext(c), opts)
+	res := &basepb.StringProto{}
+	err := Call(ctx, "flaky", "Value", &basepb.VoidProto{}, res)
+	ce, ok := err.(*CallError)
+	if !ok {
+		t.Fatalf("API call error is %T (%v), want *CallError", err, err)
+	}
+	if !strings.Contains(ce.Detail, "empty value") {
+		t.Errorf("Error detail is %q, want it to mention the validation error", ce.Detail)
+	}
+
+	// With a retry, the second attempt gets a valid response.
+	atomic.StoreInt32(&f.FlakyCalls, 0)
+	opts.Retries = 2
+	res = &basepb.StringProto{}
+	if err := Call(ctx, "flaky", "Value", &basepb.VoidProto{}, res); err != nil {
+		t.Fatalf("API call with retries failed: %v", err)
+	}
+	if got, want := res.GetValue(), "steady"; got != want {
+		t.Errorf("Response is %q, want %q", got, want)
+	}
+	if got, want := atomic.LoadInt32(&f.FlakyCalls), int32(2); got != want {
+		t.Errorf("Got %d flaky.Value requests, want %d", got, want)
+	}
+}
+
+// rawHeaderServer serves API calls with an empty response, recording the
+// header keys of each request exactly as they were sent. A net/http server
+// can't be used for this, as it canonicalizes the keys it reads.
+func rawHeaderServer(t *testing.T) (u *url.URL, keys func() []string, cleanup func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	var mu sync.Mutex
+	var last []string
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			br := bufio.NewReader(conn)
+			var ks []string
+			n := 0
+			br.ReadString('\n') // request line
+			for {
+				line, err := br.ReadString('\n')
+				line = strings.TrimRight(line, "\r\n")
+				if err != nil || line == "" {
+					break
+				}
+				kv := strings.SplitN(line, ":", 2)
+				ks = append(ks, kv[0])
+				if strings.EqualFold(kv[0], "Content-Length") && len(kv) == 2 {
+					n, _ = strconv.Atoi(strings.TrimSpace(kv[1]))
+				}
+			}
+			io.CopyN(ioutil.Discard, br, int64(n))
+			mu.Lock()
+			last = ks
+			mu.Unlock()
+
+			body, _ := proto.Marshal(&remotepb.Response{Response: []byte{}})
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+			conn.Close()
+		}
+	}()
+	u = &url.URL{Scheme: "http", Host: ln.Addr().String(), Path: apiPath}
+	keys = func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return last
+	}
+	return u, keys, func() { ln.Close() }
+}
+
+func TestAPICallRetryResetsResponse(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	// The first attempt decodes a response, then fails validation.
+	// The retry fails without decoding anything.
+	ctx := WithCallOptions(toContext(c), &CallOptions{
+		Retries: 1,
+		ValidateResponse: func(out proto.Message) error {
+			f.respondWithRPCError("echo", "Echo", remotepb.RpcError_UNKNOWN, "backend hiccup")
+			return errors.New("not this one")
+		},
+	})
+	res := &basepb.StringProto{}
+	err := Call(ctx, "echo", "Echo", &basepb.StringProto{Value: proto.String("partial")}, res)
+	if ce, ok := err.(*CallError); !ok || ce.Detail != "backend hiccup" {
+		t.Fatalf("API call returned %v, want the retry's error", err)
+	}
+	if res.Value != nil {
+		t.Errorf("Response holds %q from the failed first attempt, want it reset", res.GetValue())
+	}
+}
+
+func TestAPICallRetryableCodes(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	ctx := WithCallOptions(toContext(c), &CallOptions{Retries: 1})
+	testCases := []struct {
+		code remotepb.RpcError_ErrorCode
+		want int32 // requests made
+	}{
+		{remotepb.RpcError_UNKNOWN, 2},
+		{remotepb.RpcError_CANCELLED, 1}, // a timeout
+		{remotepb.RpcError_BAD_REQUEST, 1},
+		{remotepb.RpcError_OVER_QUOTA, 1},
+		{remotepb.RpcError_SECURITY_VIOLATION, 1},
+		{remotepb.RpcError_CAPABILITY_DISABLED, 1},
+		{remotepb.RpcError_FEATURE_DISABLED, 1},
+		{remotepb.RpcError_CALL_NOT_FOUND, 1},
+		{remotepb.RpcError_REQUEST_TOO_LARGE, 1},
+	}
+	for _, tc := range testCases {
+		f.respondWithRPCError("echo", "Echo", tc.code, "failed")
+		before := atomic.LoadInt32(&f.Requests)
+		Call(ctx, "echo", "Echo", &basepb.StringProto{Value: proto.String("hi")}, &basepb.StringProto{})
+		if got := atomic.LoadInt32(&f.Requests) - before; got != tc.want {
+			t.Errorf("Call failing with %v made %d requests, want %d", tc.code, got, tc.want)
+		}
+	}
+
+	// Nor are calls the client refuses to make.
+	bad := WithCallOptions(toContext(c), &CallOptions{ParentSpanID: "1\r\nX-Injected: 1"})
+	err := Call(bad, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	if err == nil || retryable(bad, err) {
+		t.Errorf("Call with a line break in a header option returned %v, want an error that isn't retried", err)
+	}
+}
+
+func TestCanonicalHeaders(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+	u, keys, stop := rawHeaderServer(t)
+	defer stop()
+	c.apiURL = u
+
+	hasKey := func(key string) bool {
+		for _, k := range keys() {
+			if k == key {
+				return true
+			}
+		}
+		return false
+	}
+
+	if err := Call(toContext(c), "actordb", "LookupActor", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if !hasKey("X-Google-Dappertraceinfo") {
+		t.Errorf("Header keys are %q, want canonical X-Google-Dappertraceinfo", keys())
+	}
+
+	SetCanonicalHeaders(false)
+	defer SetCanonicalHeaders(true)
+	if err := Call(toContext(c), "actordb", "LookupActor", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if !hasKey("X-Google-DapperTraceInfo") {
+		t.Errorf("Header keys are %q, want X-Google-DapperTraceInfo", keys())
+	}
+}
+
+func TestAPICallTimeToFirstByte(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	var info CallInfo
+	ctx := WithCallOptions(toContext(c), &CallOptions{
+		OnComplete: func(ci CallInfo) { info = ci },
+	})
+	if err := Call(ctx, "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if info.TimeToFirstByte < 50*time.Millisecond {
+		t.Errorf("TimeToFirstByte = %v, want at least the 50ms the server delayed", info.TimeToFirstByte)
+	}
+	if info.TimeToFirstByte > info.Duration {
+		t.Errorf("TimeToFirstByte = %v, want no more than the call duration %v", info.TimeToFirstByte, info.Duration)
+	}
+}
+
+func TestCallJSON(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	tmpl := &basepb.StringProto{}
+	got, err := c.CallJSON("actordb", "LookupActor", []byte(`{"value": "Doctor Who"}`), tmpl, nil)
+	if err != nil {
+		t.Fatalf("CallJSON failed: %v", err)
+	}
+	if want := `{"value":"David Tennant"}`; string(got) != want {
+		t.Errorf("CallJSON returned %s, want %s", got, want)
+	}
+	if tmpl.Value != nil {
+		t.Errorf("CallJSON set the template's value to %q, want it left alone", tmpl.GetValue())
+	}
+
+	if _, err := c.CallJSON("actordb", "LookupActor", []byte(`{"value": `), tmpl, nil); err == nil {
+		t.Error("CallJSON with bad JSON succeeded")
+	}
+}
+
+func TestAPICallEscalatingDeadlines(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	call := func(deadlines ...time.Duration) error {
+		ctx := WithCallOptions(toContext(c), &CallOptions{EscalatingDeadlines: deadlines})
+		return Call(ctx, "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{})
+	}
+	// The fake takes 50ms to respond.
+	if err := call(10 * time.Millisecond); err != errTimeout {
+		t.Errorf("API call with a short deadline returned %v, want errTimeout", err)
+	}
+	if err := call(10*time.Millisecond, time.Second); err != nil {
+		t.Errorf("API call with an escalated deadline failed: %v", err)
+	}
+}
+
+func TestAPICallMarshalTime(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	var info CallInfo
+	ctx := WithCallOptions(toContext(c), &CallOptions{OnComplete: func(ci CallInfo) { info = ci }})
+	if err := Call(ctx, "blob", "Read", &basepb.Integer32Proto{Value: proto.Int32(1 << 20)}, &basepb.BytesProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if info.MarshalTime <= 0 || info.UnmarshalTime <= 0 {
+		t.Errorf("MarshalTime = %v, UnmarshalTime = %v, want both measured", info.MarshalTime, info.UnmarshalTime)
+	}
+	if network := info.Duration - info.MarshalTime - info.UnmarshalTime; network <= 0 {
+		t.Errorf("Marshaling took %v of the %v call, want it to leave time for the network", info.MarshalTime+info.UnmarshalTime, info.Duration)
+	}
+}
+
+func TestAPICallMinBudget(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	opts := &CallOptions{MinBudget: 100 * time.Millisecond}
+	before := atomic.LoadInt32(&f.Requests)
+	err := Call(WithCallOptions(toContext(c.ChildContext(10*time.Millisecond)), opts), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	ce, ok := err.(*CallError)
+	if !ok || ce.Code != int32(remotepb.RpcError_CANCELLED) || !strings.Contains(ce.Detail, "insufficient budget") {
+		t.Errorf("API call with too little budget returned %v, want CANCELLED for insufficient budget", err)
+	}
+	if n := atomic.LoadInt32(&f.Requests) - before; n != 0 {
+		t.Errorf("Service bridge got %d requests, want none", n)
+	}
+
+	if err := Call(WithCallOptions(toContext(c.ChildContext(time.Second)), opts), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Errorf("API call with enough budget failed: %v", err)
+	}
+}
+
+func TestFakeHandledCalls(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	type result struct {
+		callID, sent, got string
+	}
+	results := make(chan result, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := result{sent: fmt.Sprintf("message %d", i)}
+			ctx := WithCallOptions(toContext(c), &CallOptions{OnComplete: func(ci CallInfo) { r.callID = ci.CallID }})
+			res := &basepb.StringProto{}
+			if err := Call(ctx, "echo", "Echo", &basepb.StringProto{Value: proto.String(r.sent)}, res); err != nil {
+				t.Errorf("API call %d failed: %v", i, err)
+			}
+			r.got = res.GetValue()
+			results <- r
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	byID := make(map[string]handledCall)
+	for _, hc := range f.handledCalls() {
+		byID[hc.callID] = hc
+	}
+	for r := range results {
+		hc, ok := byID[r.callID]
+		if !ok {
+			t.Errorf("Call %s of %q wasn't handled", r.callID, r.sent)
+			continue
+		}
+		req := &basepb.StringProto{}
+		if err := proto.Unmarshal(hc.request, req); err != nil {
+			t.Errorf("Call %s: bad request: %v", r.callID, err)
+			continue
+		}
+		if req.GetValue() != r.sent || r.got != r.sent {
+			t.Errorf("Call %s sent %q and got %q, and the fake received %q; want them all the same", r.callID, r.sent, r.got, req.GetValue())
+		}
+	}
+}
+
+func TestAPICallRemoteAddr(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	var info CallInfo
+	ctx := WithCallOptions(toContext(c), &CallOptions{
+		OnComplete: func(ci CallInfo) { info = ci },
+	})
+	for i := 0; i < 2; i++ { // once on a new connection, once on a pooled one
+		if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+			t.Fatalf("API call failed: %v", err)
+		}
+		if info.RemoteAddr != c.apiURL.Host {
+			t.Errorf("Call %d: RemoteAddr = %q, want the fake server's %q", i, info.RemoteAddr, c.apiURL.Host)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	c.RateLimit("actordb", 20) // one call every 50ms
+	call := func(ctx netcontext.Context) error {
+		return Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	}
+
+	ctx, cancel := netcontext.WithTimeout(toContext(c), time.Second)
+	defer cancel()
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := call(ctx); err != nil {
+			t.Fatalf("API call %d failed: %v", i, err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("Burst of 5 calls took %v, want at least 200ms", elapsed)
+	}
+
+	// A call whose turn won't come before its deadline fails without waiting.
+	call(toContext(c))
+	ctx, cancel = netcontext.WithTimeout(toContext(c), 10*time.Millisecond)
+	defer cancel()
+	if err := call(ctx); err != errTimeout {
+		t.Errorf("Rate limited call returned %v, want errTimeout", err)
+	}
+
+	// Other services aren't limited.
+	start = time.Now()
+	for i := 0; i < 5; i++ {
+		Call(toContext(c), "echo", "Echo", &basepb.StringProto{Value: proto.String("hi")}, &basepb.StringProto{})
+	}
+	if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+		t.Errorf("Burst of 5 unlimited calls took %v, want them unpaced", elapsed)
+	}
+
+	c.RateLimit("actordb", 0)
+	if err := call(toContext(c)); err != nil {
+		t.Errorf("API call after removing the limit failed: %v", err)
+	}
+}
+
+func TestCallRewriter(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	SetCallRewriter(func(service, method string) (string, string) {
+		if service == "actordb" && method == "LookupActor" {
+			return "echo", "Echo"
+		}
+		return service, method
+	})
+	defer SetCallRewriter(nil)
+
+	var info CallInfo
+	ctx := WithCallOptions(toContext(c), &CallOptions{
+		OnComplete: func(ci CallInfo) { info = ci },
+	})
+	res := &basepb.StringProto{}
+	if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, res); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	// echo.Echo returns its request, where actordb.LookupActor would have found the actor.
+	if got, want := res.GetValue(), "Doctor Who"; got != want {
+		t.Errorf("Response is %q, want %q from the aliased target", got, want)
+	}
+	if info.Service != "echo" || info.Method != "Echo" {
+		t.Errorf("Call info is for %s.%s, want echo.Echo", info.Service, info.Method)
+	}
+}
+
+func TestAPICallServeStaleOnError(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	var info CallInfo
+	ctx := WithCallOptions(toContext(c), &CallOptions{
+		ServeStaleOnError: true,
+		OnComplete:        func(ci CallInfo) { info = ci },
+	})
+	req := &basepb.StringProto{Value: proto.String("Doctor Who")}
+	if err := Call(ctx, "actordb", "LookupActor", req, &basepb.StringProto{}); err != nil {
+		t.Fatalf("First API call failed: %v", err)
+	}
+	if info.Stale {
+		t.Error("First API call was marked stale")
+	}
+
+	f.respondWithRPCError("actordb", "LookupActor", remotepb.RpcError_OVER_QUOTA, "you are hogging the resources!")
+	res := &basepb.StringProto{}
+	if err := Call(ctx, "actordb", "LookupActor", req, res); err != nil {
+		t.Fatalf("Failing API call wasn't served stale: %v", err)
+	}
+	if got, want := res.GetValue(), "David Tennant"; got != want {
+		t.Errorf("Stale response is %q, want %q", got, want)
+	}
+	if !info.Stale {
+		t.Error("Stale response wasn't marked stale")
+	}
+	if errs := c.SoftErrors(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "hogging") {
+		t.Errorf("Soft errors are %v, want the OVER_QUOTA failure", errs)
+	}
+
+	// Without a recorded response for the request, the error is returned.
+	err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Jon Pertwee")}, &basepb.StringProto{})
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_OVER_QUOTA) {
+		t.Errorf("API call with nothing stale returned %v, want OVER_QUOTA", err)
+	}
+
+	// Nor is a response older than the limit served.
+	SetMaxStaleness(time.Millisecond)
+	defer SetMaxStaleness(5 * time.Minute)
+	time.Sleep(5 * time.Millisecond)
+	err = Call(ctx, "actordb", "LookupActor", req, &basepb.StringProto{})
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_OVER_QUOTA) {
+		t.Errorf("API call with only an old response returned %v, want OVER_QUOTA", err)
+	}
+}
+
+func TestStaleRecordBound(t *testing.T) {
+	defer quiesce()
+	for i := 0; i < maxStaleResponses+10; i++ {
+		staleRecord("actordb", "LookupActor", &basepb.Integer32Proto{Value: proto.Int32(int32(i))}, []byte{})
+	}
+	staleCache.Lock()
+	n := len(staleCache.m)
+	staleCache.Unlock()
+	if n != maxStaleResponses {
+		t.Errorf("Stale record holds %d responses, want %d", n, maxStaleResponses)
+	}
+	// The oldest responses were forgotten first.
+	if _, ok := staleLookup("actordb", "LookupActor", &basepb.Integer32Proto{Value: proto.Int32(0)}); ok {
+		t.Error("The oldest response is still recorded")
+	}
+	if _, ok := staleLookup("actordb", "LookupActor", &basepb.Integer32Proto{Value: proto.Int32(maxStaleResponses + 9)}); !ok {
+		t.Error("The newest response isn't recorded")
+	}
+}
+
+func TestMaxConcurrentCalls(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	SetMaxConcurrentCalls(c, 2)
+	var wg sync.WaitGroup
+	errc := make(chan error, 6)
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errc <- Call(toContext(c.ChildContext(time.Second)), "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{})
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Errorf("API call failed: %v", err)
+		}
+	}
+	if got, want := atomic.LoadInt32(&f.delayMaxInFlight), int32(2); got != want {
+		t.Errorf("Most calls in flight at once = %d, want %d", got, want)
+	}
+
+	// A call that can't start before its deadline fails.
+	SetMaxConcurrentCalls(c, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Call(toContext(c), "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{})
+	}()
+	time.Sleep(10 * time.Millisecond) // let that call start
+	if err := Call(toContext(c.ChildContext(10*time.Millisecond)), "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{}); err != errTimeout {
+		t.Errorf("Call waiting past its deadline returned %v, want errTimeout", err)
+	}
+	<-done
+	SetMaxConcurrentCalls(c, 0)
+}
+
+func TestSkipInterceptors(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	var ctx netcontext.Context
+	var calls int
+	ctx = WithCallOverride(toContext(c), func(_ netcontext.Context, service, method string, in, out proto.Message) error {
+		calls++
+		if calls > 1 {
+			return errors.New("interceptor re-entered")
+		}
+		// Make the intercepted call with the intercepting context.
+		return Call(WithCallOptions(ctx, &CallOptions{SkipInterceptors: true}), service, method, in, out)
+	})
+
+	res := &basepb.StringProto{}
+	if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, res); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got, want := res.GetValue(), "David Tennant"; got != want {
+		t.Errorf("Response is %q, want %q", got, want)
+	}
+	if calls != 1 {
+		t.Errorf("Interceptor ran %d times, want 1", calls)
+	}
+}
+
+func TestCorrelateLogs(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	ctx := WithCallOverride(toContext(c), func(ctx netcontext.Context, service, method string, in, out proto.Message) error {
+		Logf(ctx, 1, "looking up %s", "Doctor Who")
+		return nil
+	})
+	ctx = WithCallOptions(ctx, &CallOptions{CorrelateLogs: true})
+	if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{}, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	Logf(ctx, 1, "after the call")
+
+	logs := c.BufferedLogs()
+	if len(logs) != 2 {
+		t.Fatalf("Got %d log lines, want 2: %+v", len(logs), logs)
+	}
+	if got, want := logs[0].Message, `^looking up Doctor Who \[call=\S+ service=actordb\]$`; !regexp.MustCompile(want).MatchString(got) {
+		t.Errorf("Log during the call is %q, want it to match %q", got, want)
+	}
+	if got, want := logs[1].Message, "after the call"; got != want {
+		t.Errorf("Log after the call is %q, want %q", got, want)
+	}
+}
+
+func TestCorrelateLogsOfCall(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	SetSoftDeadlineRatio(0.5)
+	defer SetSoftDeadlineRatio(0)
+	SetMethodPolicy("actordb", "LookupActor", false)
+	defer SetMethodPolicy("actordb", "LookupActor", true)
+
+	ctx := WithCallOptions(toContext(c), &CallOptions{Timeout: 90 * time.Millisecond, CorrelateLogs: true})
+	if err := Call(ctx, "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{}, &basepb.StringProto{}); err == nil {
+		t.Fatal("Call to a disabled method succeeded")
+	}
+
+	logs := c.BufferedLogs()
+	want := []string{
+		`^API call delay\.Respond took .* timeout \[call=\S+ service=delay\]$`,
+		`^API call blocked by policy: .* \[call=\S+ service=actordb\]$`,
+	}
+	if len(logs) != len(want) {
+		t.Fatalf("Got %d log lines, want %d: %+v", len(logs), len(want), logs)
+	}
+	for i, w := range want {
+		if got := logs[i].Message; !regexp.MustCompile(w).MatchString(got) {
+			t.Errorf("Log line %d is %q, want it to match %q", i, got, w)
+		}
+	}
+}
+
+// wrappedError adds context to an error, as a call override might.
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string { return e.msg + ": " + e.err.Error() }
+func (e *wrappedError) Unwrap() error { return e.err }
+
+func TestRootCallError(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	ctx := WithCallOverride(toContext(c), func(ctx netcontext.Context, service, method string, in, out proto.Message) error {
+		err := Call(WithCallOptions(ctx, &CallOptions{SkipInterceptors: true}), service, method, in, out)
+		return &wrappedError{"inner", &wrappedError{"outer", err}}
+	})
+	err := Call(ctx, "errors", "OverQuota", &basepb.VoidProto{}, &basepb.VoidProto{})
+	if _, ok := err.(*wrappedError); !ok {
+		t.Fatalf("Intercepted call returned %T (%v), want the interceptor's error", err, err)
+	}
+	ce := RootCallError(err)
+	if ce == nil || ce.Code != int32(remotepb.RpcError_OVER_QUOTA) {
+		t.Errorf("RootCallError(%v) = %v, want the OVER_QUOTA *CallError", err, ce)
+	}
+
+	if ce := RootCallError(&wrappedError{"no call error", errors.New("plain")}); ce != nil {
+		t.Errorf("RootCallError of a chain without a *CallError = %v, want nil", ce)
+	}
+	if ce := RootCallError(nil); ce != nil {
+		t.Errorf("RootCallError(nil) = %v, want nil", ce)
+	}
+}
+
+func TestErrorMapper(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	errBusy := errors.New("busy")
+	SetErrorMapper(func(ce *CallError) error {
+		if ce.Code == int32(remotepb.RpcError_OVER_QUOTA) {
+			return errBusy
+		}
+		return nil
+	})
+	defer SetErrorMapper(nil)
+
+	if err := Call(toContext(c), "errors", "OverQuota", &basepb.VoidProto{}, &basepb.VoidProto{}); err != errBusy {
+		t.Errorf("OverQuota call returned %v, want the mapped error", err)
+	}
+	// Errors the mapper leaves alone are returned unchanged.
+	err := Call(toContext(c), "errors", "Non200", &basepb.VoidProto{}, &basepb.VoidProto{})
+	if _, ok := err.(*CallError); !ok {
+		t.Errorf("Non200 call returned %T (%v), want *CallError", err, err)
+	}
+
+	// Log flushes see their errors unmapped, so a timeout is handled as one.
+	SetErrorMapper(func(*CallError) error { return errBusy })
+	SetFlushTimeout(10 * time.Millisecond)
+	defer SetFlushTimeout(0)
+	logf(c, 1, "slow to flush")
+	if _, err := c.flushLog(true); err != errTimeout {
+		t.Errorf("Timed out log flush returned %v, want errTimeout", err)
+	}
+	c.pendingLogs.Lock()
+	dropped := c.pendingLogs.dropped
+	c.pendingLogs.Unlock()
+	if dropped != 1 {
+		t.Errorf("Dropped %d lines of a timed out flush, want 1", dropped)
+	}
+}
+
+func TestAPICallRedirect(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	before := atomic.LoadInt32(&f.Requests)
+	err := Call(toContext(c), "errors", "Redirect", &basepb.VoidProto{}, &basepb.VoidProto{})
+	ce, ok := err.(*CallError)
+	if !ok {
+		t.Fatalf("Redirected call returned %T (%v), want *CallError", err, err)
+	}
+	if want := `redirected with HTTP 302 to "/moved"`; !strings.Contains(ce.Detail, want) {
+		t.Errorf("Redirected call failed with %q, want it to mention %q", ce.Detail, want)
+	}
+	if n := atomic.LoadInt32(&f.Requests) - before; n != 1 {
+		t.Errorf("Service bridge got %d requests, want 1", n)
+	}
+}
+
+func TestAPICallApplicationError(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	// Errors reported by the service itself are distinct from RPC failures.
+	err := Call(toContext(c), "errors", "ApplicationError", &basepb.VoidProto{}, &basepb.VoidProto{})
+	ae, ok := err.(*APIError)
+	if !ok {
+		t.Fatalf("API call error is %T (%v), want *APIError", err, err)
+	}
+	if ae.Service != "errors" || ae.Code != 3 || ae.Detail != "no such widget" {
+		t.Errorf("Got %+v, want service errors, code 3 and detail %q", ae, "no such widget")
+	}
+}
+
+func TestAPICallTicketNormalized(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	// The fake API server only accepts the exact ticket.
+	c.req.Header.Set(ticketHeader, " s3cr3t\n")
+	if err := Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call with stray whitespace in the ticket failed: %v", err)
+	}
+	c.pendingLogs.Lock()
+	defer c.pendingLogs.Unlock()
+	if n := len(c.pendingLogs.lines); n != 1 || !strings.Contains(c.pendingLogs.lines[0].GetMessage(), "malformed") {
+		t.Errorf("Got %d log lines, want one about the malformed ticket", n)
+	}
+
+	for _, tc := range []struct{ in, want string }{
+		{"s3cr3t", "s3cr3t"},
+		{"\ts3cr3t ", "s3cr3t"},
+		{`"s3cr3t"`, "s3cr3t"},
+		{`" s3cr3t"`, "s3cr3t"},
+	} {
+		if got := normalizeTicket(tc.in); got != tc.want {
+			t.Errorf("normalizeTicket(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAPICallParentSpanID(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	c.req.Header.Set(traceHeader, "105445aa7843bc8bf206b12000100000/1;o=1")
+	call := func(ctx netcontext.Context) string {
+		if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+			t.Fatalf("API call failed: %v", err)
+		}
+		return f.lastHeader("actordb", "LookupActor", traceHeader)
+	}
+
+	if got, want := call(toContext(c)), "105445aa7843bc8bf206b12000100000/1;o=1"; got != want {
+		t.Errorf("Without a parent span ID, trace header = %q, want the inbound %q", got, want)
+	}
+	ctx := WithCallOptions(toContext(c), &CallOptions{ParentSpanID: "42"})
+	if got, want := call(ctx), "105445aa7843bc8bf206b12000100000/42;o=1"; got != want {
+		t.Errorf("With a parent span ID, trace header = %q, want %q", got, want)
+	}
+
+	c.req.Header.Set(traceHeader, "105445aa7843bc8bf206b12000100000")
+	if got, want := call(ctx), "105445aa7843bc8bf206b12000100000/42"; got != want {
+		t.Errorf("With a bare trace ID, trace header = %q, want %q", got, want)
+	}
+}
+
+func TestAPICallRequireNonEmptyResponse(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	ctx := WithCallOptions(toContext(c), &CallOptions{RequireNonEmptyResponse: true})
+	err := Call(ctx, "empty", "Respond", &basepb.VoidProto{}, &basepb.StringProto{})
+	if ce, ok := err.(*CallError); !ok || !strings.Contains(ce.Detail, "empty response") {
+		t.Errorf("Empty response for StringProto: got %v, want *CallError about the empty response", err)
+	}
+	// An empty response is the normal encoding of a VoidProto.
+	if err := Call(ctx, "empty", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Errorf("Empty response for VoidProto: %v", err)
+	}
+}
+
+func TestAPICallHeaderInjection(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	c.req.Header.Set(traceHeader, "105445aa7843bc8bf206b12000100000/1;o=1")
+	ctx := WithCallOptions(toContext(c), &CallOptions{ParentSpanID: "42\r\nX-Injected: yes"})
+	err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_BAD_REQUEST) {
+		t.Errorf("API call with a line break in the parent span ID returned %v, want BAD_REQUEST", err)
+	}
+	if got := f.lastHeader("actordb", "LookupActor", "X-Injected"); got != "" {
+		t.Errorf("Injected header reached the API server with value %q", got)
+	}
+
+	// Line breaks are stripped from stat tags.
+	ctx = WithCallOptions(toContext(c), &CallOptions{StatTags: map[string]string{"test": "injection\nfake_metric 1"}})
+	if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	k := StatKey{Service: "actordb", Method: "LookupActor", Tags: "test=injectionfake_metric 1"}
+	if got := CallStats()[k].Calls; got != 1 {
+		t.Errorf("CallStats()[%+v].Calls = %d, want 1", k, got)
+	}
+}
+
+func TestAPICallBackendShard(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	call := func(opts *CallOptions) CallInfo {
+		var info CallInfo
+		opts.OnComplete = func(ci CallInfo) { info = ci }
+		if err := Call(WithCallOptions(toContext(c), opts), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+			t.Fatalf("API call failed: %v", err)
+		}
+		return info
+	}
+	info := call(&CallOptions{BackendShard: "shard-7"})
+	if got := f.lastHeader("actordb", "LookupActor", apiBackendShardHeader); got != "shard-7" {
+		t.Errorf("Backend shard header = %q, want %q", got, "shard-7")
+	}
+	if info.BackendShard != "shard-7" {
+		t.Errorf("CallInfo.BackendShard = %q, want %q", info.BackendShard, "shard-7")
+	}
+
+	// Calls are routed normally by default.
+	call(&CallOptions{})
+	if got := f.lastHeader("actordb", "LookupActor", apiBackendShardHeader); got != "" {
+		t.Errorf("Backend shard header = %q by default, want none", got)
+	}
+
+	ctx := WithCallOptions(toContext(c), &CallOptions{BackendShard: "7\r\nX-Injected: yes"})
+	err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_BAD_REQUEST) {
+		t.Errorf("API call with a line break in the backend shard returned %v, want BAD_REQUEST", err)
+	}
+}
+
+func TestAPICallHeaders(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	call := func(h http.Header) error {
+		ctx := WithCallOptions(toContext(c), &CallOptions{Headers: h})
+		return Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	}
+	h := http.Header{}
+	h.Set("X-Experiment-Arm", "b")
+	h.Set("X-Google-RPC-Service-Method", "/Spoofed.Method")
+	h.Set(traceHeader, "spoofed")
+	if err := call(h); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got := f.lastHeader("actordb", "LookupActor", "X-Experiment-Arm"); got != "b" {
+		t.Errorf("Custom header = %q, want %q", got, "b")
+	}
+	if got := f.lastHeader("actordb", "LookupActor", apiMethodHeader); got != "/VMRemoteAPI.CallRemoteAPI" {
+		t.Errorf("Service bridge method header = %q, want it left alone", got)
+	}
+	if got := f.lastHeader("actordb", "LookupActor", traceHeader); got == "spoofed" {
+		t.Errorf("Trace header = %q, want it left alone", got)
+	}
+
+	// The headers of one call don't leak to the next.
+	if err := call(nil); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got := f.lastHeader("actordb", "LookupActor", "X-Experiment-Arm"); got != "" {
+		t.Errorf("Custom header = %q on a call without it, want none", got)
+	}
+
+	if err := call(http.Header{"X-Bad": {"a\r\nX-Injected: yes"}}); err == nil {
+		t.Error("API call with a line break in a header succeeded")
+	}
+}
+
+func TestAPICallAcceptCodes(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	// The fake fails errors.ApplicationError with code 3.
+	var code int32 = -1
+	ctx := WithCallOptions(toContext(c), &CallOptions{AcceptCodes: []int32{1, 3}, ResultCode: &code})
+	if err := Call(ctx, "errors", "ApplicationError", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Errorf("API call failing with an accepted code returned %v, want success", err)
+	}
+	if code != 3 {
+		t.Errorf("ResultCode = %d, want 3", code)
+	}
+
+	if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if code != 0 {
+		t.Errorf("ResultCode = %d after a response, want 0", code)
+	}
+
+	ctx = WithCallOptions(toContext(c), &CallOptions{AcceptCodes: []int32{5}})
+	err := Call(ctx, "errors", "ApplicationError", &basepb.VoidProto{}, &basepb.VoidProto{})
+	if ae, ok := err.(*APIError); !ok || ae.Code != 3 {
+		t.Errorf("API call failing with another code returned %v, want an *APIError with code 3", err)
+	}
+}
+
+func TestAPICallIfNoneMatch(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	var notModified bool
+	call := func(tag string) *basepb.StringProto {
+		res := &basepb.StringProto{}
+		ctx := WithCallOptions(toContext(c), &CallOptions{IfNoneMatch: tag, NotModified: &notModified})
+		if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, res); err != nil {
+			t.Fatalf("API call with tag %q failed: %v", tag, err)
+		}
+		return res
+	}
+
+	res := call("tennant-v1")
+	if got := f.lastHeader("actordb", "LookupActor", apiIfNoneMatchHeader); got != "tennant-v1" {
+		t.Errorf("If-None-Match header = %q, want %q", got, "tennant-v1")
+	}
+	if !notModified {
+		t.Error("NotModified = false for a current tag, want true")
+	}
+	if res.Value != nil {
+		t.Errorf("Response is %q for a current tag, want it left unset", res.GetValue())
+	}
+
+	res = call("tennant-v0")
+	if notModified {
+		t.Error("NotModified = true for a stale tag, want false")
+	}
+	if got, want := res.GetValue(), "David Tennant"; got != want {
+		t.Errorf("Response is %q for a stale tag, want %q", got, want)
+	}
+}
+
+func TestAPICallTicket(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	lastTicket := func() string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.lastTicket
+	}
+	ctx := WithCallOptions(toContext(c), &CallOptions{Ticket: "0th3r"})
+	err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	if got := lastTicket(); got != "0th3r" {
+		t.Errorf("Call was made with ticket %q, want the per-call ticket %q", got, "0th3r")
+	}
+	// The fake only accepts the request's ticket.
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_SECURITY_VIOLATION) {
+		t.Errorf("Call with another ticket returned %v, want SECURITY_VIOLATION", err)
+	}
+
+	// Other calls use the request's ticket.
+	if err := Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Errorf("API call failed: %v", err)
+	}
+	if got := lastTicket(); got != "s3cr3t" {
+		t.Errorf("Call was made with ticket %q, want the request's", got)
+	}
+
+	ctx = WithCallOptions(toContext(c), &CallOptions{Ticket: " \"\" "})
+	err = Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_BAD_REQUEST) {
+		t.Errorf("Call with a blank ticket returned %v, want BAD_REQUEST", err)
+	}
+}
+
+func TestAPICallOmitTicket(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	lastTicket := func() *string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.lastRequestID
+	}
+	ctx := WithCallOptions(toContext(c), &CallOptions{OmitTicket: true})
+	if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call without a ticket failed: %v", err)
+	}
+	if got := lastTicket(); got != nil {
+		t.Errorf("Call was made with ticket %q, want none", *got)
+	}
+
+	if err := Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got := lastTicket(); got == nil || *got != "s3cr3t" {
+		t.Errorf("Call was made without the request's ticket")
+	}
+}
+
+func TestMethodPolicy(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	SetMethodPolicy("actordb", "LookupActor", false)
+	defer SetMethodPolicy("actordb", "LookupActor", true)
+	before := atomic.LoadInt32(&f.Requests)
+	err := Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_FEATURE_DISABLED) || !strings.Contains(ce.Detail, "method disabled") {
+		t.Errorf("Call to a denied method returned %v, want a method disabled *CallError", err)
+	}
+	err = c.CallStream("actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, ioutil.Discard, nil)
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_FEATURE_DISABLED) {
+		t.Errorf("CallStream of a denied method returned %v, want a method disabled *CallError", err)
+	}
+	if atomic.LoadInt32(&f.Requests) != before {
+		t.Error("Call to a denied method reached the API server")
+	}
+	logs := c.BufferedLogs()
+	if len(logs) == 0 || !strings.Contains(logs[len(logs)-1].Message, "actordb.LookupActor") {
+		t.Errorf("Logs = %+v, want one about the blocked call", logs)
+	}
+
+	// Other methods are unaffected.
+	if err := Call(toContext(c), "attachments", "Echo", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Errorf("Call to an allowed method failed: %v", err)
+	}
+
+	SetMethodPolicy("actordb", "LookupActor", true)
+	if err := Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Errorf("Call to a method allowed again failed: %v", err)
+	}
+}
+
+func TestLastDeadline(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	if _, ok := f.LastDeadline("actordb", "LookupActor"); ok {
+		t.Error("LastDeadline reported a deadline before any call")
+	}
+	ctx := WithCallOptions(toContext(c), &CallOptions{Timeout: 200 * time.Millisecond})
+	if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	d, ok := f.LastDeadline("actordb", "LookupActor")
+	if !ok || d < 150*time.Millisecond || d > 200*time.Millisecond {
+		t.Errorf("LastDeadline() = %v, %t, want about 200ms", d, ok)
+	}
+}
+
+func TestAPICallFreshConnection(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	var conns int32 // atomic
+	srv := httptest.NewUnstartedServer(f)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	c.apiURL = &url.URL{Scheme: "http", Host: srv.Listener.Addr().String(), Path: apiPath}
+
+	call := func(ctx netcontext.Context) int32 {
+		if err := Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+			t.Fatalf("API call failed: %v", err)
+		}
+		return atomic.LoadInt32(&conns)
+	}
+	pooled := call(toContext(c))
+	if got := call(toContext(c)); got != pooled {
+		t.Fatalf("Second call opened a connection; want the pooled one reused")
+	}
+	fresh := WithCallOptions(toContext(c), &CallOptions{FreshConnection: true})
+	if got, want := call(fresh), pooled+1; got != want {
+		t.Errorf("After a call with FreshConnection: %d connections, want %d", got, want)
+	}
+}
+
+// blobBytes returns n bytes of test data for the fake blob service.
+func blobBytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestCallStream(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	const size = 4 << 20
+	want, err := proto.Marshal(&basepb.BytesProto{Value: blobBytes(size)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := c.CallStream("blob", "Read", &basepb.Integer32Proto{Value: proto.Int32(size)}, &buf, nil); err != nil {
+		t.Fatalf("CallStream failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("CallStream wrote %d bytes that differ from the %d byte response", buf.Len(), len(want))
+	}
+
+	// A response over the size limit fails.
+	buf.Reset()
+	err = c.CallStream("blob", "Read", &basepb.Integer32Proto{Value: proto.Int32(size)}, &buf, &CallOptions{MaxResponseSize: size / 2})
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_RESPONSE_TOO_LARGE) {
+		t.Errorf("CallStream over the size limit returned %v, want RESPONSE_TOO_LARGE", err)
+	}
+
+	// Errors reported by the service are returned.
+	buf.Reset()
+	err = c.CallStream("errors", "OverQuota", &basepb.VoidProto{}, &buf, nil)
+	if ce, ok := err.(*CallError); !ok || ce.Code != int32(remotepb.RpcError_OVER_QUOTA) {
+		t.Errorf("CallStream of errors.OverQuota returned %v, want OVER_QUOTA", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("CallStream of a failed call wrote %d bytes", buf.Len())
+	}
+
+	// The deadline applies.
+	c.deadline = time.Now().Add(10 * time.Millisecond)
+	if err := c.CallStream("delay", "Respond", &basepb.VoidProto{}, &buf, nil); err != errTimeout {
+		t.Errorf("CallStream past the deadline returned %v, want errTimeout", err)
+	}
+}
+
+func TestAPICallTrailerError(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	err := Call(toContext(c), "errors", "TrailerError", &basepb.VoidProto{}, &basepb.VoidProto{})
+	ce, ok := err.(*CallError)
+	if !ok {
+		t.Fatalf("API call error is %T (%v), want *CallError", err, err)
+	}
+	if got, want := ce.Detail, "backend went away mid-stream"; got != want {
+		t.Errorf("ce.Detail = %q, want %q", got, want)
+	}
+}
+
+func TestAPICallUnlabeledGzip(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	want := strings.Repeat("squeeze me ", 100)
+	res := &basepb.StringProto{}
+	if err := Call(toContext(c), "gzip", "Echo", &basepb.StringProto{Value: proto.String(want)}, res); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got := res.GetValue(); got != want {
+		t.Errorf("Response is %q, want %q", got, want)
+	}
+
+	// Responses that decompress to more than the limit are rejected.
+	defer func(n int64) { maxDecompressedSize = n }(maxDecompressedSize)
+	maxDecompressedSize = 100
+	err := Call(toContext(c), "gzip", "Echo", &basepb.StringProto{Value: proto.String(want)}, res)
+	if ce, ok := err.(*CallError); !ok || !strings.Contains(ce.Detail, "exceeds 100 bytes") {
+		t.Errorf("Oversized gzip response: got error %v, want decompression limit error", err)
+	}
+}
+
+func TestAPICallContentEncoding(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	want := strings.Repeat("squeeze me ", 100)
+	for _, enc := range []string{"identity", "gzip", "deflate"} {
+		res := &basepb.StringProto{}
+		if err := Call(toContext(c), "encoding", enc, &basepb.StringProto{Value: proto.String(want)}, res); err != nil {
+			t.Errorf("%s: API call failed: %v", enc, err)
+			continue
+		}
+		if got := res.GetValue(); got != want {
+			t.Errorf("%s: response is %q, want %q", enc, got, want)
+		}
+		if got, want := f.lastHeader("encoding", enc, "Accept-Encoding"), "gzip, deflate"; got != want {
+			t.Errorf("%s: Accept-Encoding = %q, want %q", enc, got, want)
+		}
+	}
+
+	err := Call(toContext(c), "encoding", "br", &basepb.StringProto{Value: proto.String(want)}, &basepb.StringProto{})
+	if ce, ok := err.(*CallError); !ok || !strings.Contains(ce.Detail, `unsupported Content-Encoding "br"`) {
+		t.Errorf("Unsupported encoding: got error %v, want one naming the encoding", err)
+	}
+}
+
+func TestCallID(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	var infos []CallInfo
+	ctx := WithCallOptions(toContext(c), &CallOptions{
+		OnComplete: func(info CallInfo) { infos = append(infos, info) },
+		LogCallID:  true,
+	})
+	if err := Call(ctx, "attachments", "Echo", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	err := Call(ctx, "errors", "OverQuota", &basepb.VoidProto{}, &basepb.VoidProto{})
+	ce, ok := err.(*CallError)
+	if !ok {
+		t.Fatalf("API call error is %T (%v), want *CallError", err, err)
+	}
+
+	if len(infos) != 2 {
+		t.Fatalf("OnComplete called %d times, want 2", len(infos))
+	}
+	if infos[0].CallID == "" || infos[0].CallID == infos[1].CallID {
+		t.Errorf("Call IDs are %q and %q, want distinct non-empty IDs", infos[0].CallID, infos[1].CallID)
+	}
+	if got, want := ce.CallID, infos[1].CallID; got != want {
+		t.Errorf("Error call ID = %q, want %q from OnComplete", got, want)
+	}
+	if infos[1].Err != err || infos[1].Service != "errors" || infos[1].Method != "OverQuota" {
+		t.Errorf("OnComplete got %+v for failed call", infos[1])
+	}
+
+	c.pendingLogs.Lock()
+	n := len(c.pendingLogs.lines)
+	c.pendingLogs.Unlock()
+	if n != 2 {
+		t.Errorf("Got %d debug log lines, want 2", n)
+	}
+}
+
+func TestAPICallPartialResponse(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	testCases := []struct {
+		method string
+		detail string
+	}{
+		{"ShortResponse", "service bridge response truncated: got 13 of 100 bytes"},
+		{"ConnReset", "service bridge connection reset after 13 response bytes"},
+	}
+	for _, tc := range testCases {
+		err := Call(toContext(c), "errors", tc.method, &basepb.VoidProto{}, &basepb.VoidProto{})
+		ce, ok := err.(*CallError)
+		if !ok {
+			t.Errorf("%s: API call error is %T (%v), want *CallError", tc.method, err, err)
+			continue
+		}
+		if !strings.HasPrefix(ce.Detail, tc.detail) {
+			t.Errorf("%s: ce.Detail = %q, want prefix %q", tc.method, ce.Detail, tc.detail)
+		}
+	}
+}
+
+func TestAPICallDialFailure(t *testing.T) {
+	// See what happens if the API host is unresponsive.
+	// This should time out quickly, not hang forever.
+	_, c, cleanup := setup()
+	defer cleanup()
+	// Reset the URL to the production address so that dialing fails.
+	c.apiURL = apiURL()
+
+	start := time.Now()
+	err := Call(toContext(c), "foo", "bar", &basepb.VoidProto{}, &basepb.VoidProto{})
+	const max = 1 * time.Second
+	if taken := time.Since(start); taken > max {
+		t.Errorf("Dial hang took too long: %v > %v", taken, max)
+	}
+	if err == nil {
+		t.Error("Call did not fail")
+	}
+}
+
+func TestAPICallDialFailureDetail(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	// Find a port that refuses connections.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := l.Addr().String()
+	l.Close()
+
+	for _, tc := range []struct {
+		host, want string
+	}{
+		{"", "API host unset"},
+		{refused, "service bridge connection refused"},
+	} {
+		c.apiURL = &url.URL{Scheme: "http", Host: tc.host, Path: apiPath}
+		err := Call(toContext(c), "foo", "bar", &basepb.VoidProto{}, &basepb.VoidProto{})
+		if ce, ok := err.(*CallError); !ok || !strings.Contains(ce.Detail, tc.want) {
+			t.Errorf("Call with API host %q returned %v, want a *CallError about %q", tc.host, err, tc.want)
+		}
+	}
+}
+
+func TestDelayedLogFlushing(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	http.HandleFunc("/slow_log", func(w http.ResponseWriter, r *http.Request) {
+		logC := WithContext(netcontext.Background(), r)
+		fromContext(logC).apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		Logf(logC, 1, "It's a lovely day.")
+		w.WriteHeader(200)
+		time.Sleep(1200 * time.Millisecond)
+		w.Write(make([]byte, 100<<10)) // write 100 KB to force HTTP flush
+	})
+
+	r := &http.Request{
+		Method: "GET",
+		URL: &url.URL{
+			Scheme: "http",
+			Path:   "/slow_log",
+		},
+		Header: c.req.Header,
+		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+	}
+	w := httptest.NewRecorder()
+
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		handleHTTP(w, r)
+	}()
+	// Check that the log flush eventually comes in.
+	time.Sleep(1200 * time.Millisecond)
+	if f := atomic.LoadInt32(&f.LogFlushes); f != 1 {
+		t.Errorf("After 1.2s: f.LogFlushes = %d, want 1", f)
+	}
+
+	<-handled
+	const hdr = "X-AppEngine-Log-Flush-Count"
+	if got, want := w.HeaderMap.Get(hdr), "1"; got != want {
+		t.Errorf("%s header = %q, want %q", hdr, got, want)
+	}
+	if got, want := atomic.LoadInt32(&f.LogFlushes), int32(2); got != want {
+		t.Errorf("After HTTP response: f.LogFlushes = %d, want %d", got, want)
+	}
+
+}
+
+func TestLogFlushConcurrentWithResponse(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	logging := make(chan struct{})
+	http.HandleFunc("/busy_log", func(w http.ResponseWriter, r *http.Request) {
+		logC := WithContext(netcontext.Background(), r)
+		fromContext(logC).apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		go func() {
+			// Keep logging while the response is written and the logs are flushed.
+			defer func() { logging <- struct{}{} }()
+			for i := 0; i < 2000; i++ {
+				Logf(logC, 1, "line %d", i)
+			}
+		}()
+		w.Write([]byte("done"))
+	})
+
+	for _, failFlush := range []bool{false, true} {
+		if failFlush {
+			// Failed flushes put their lines back in the buffer.
+			f.respondWithRPCError("logservice", "Flush", remotepb.RpcError_UNKNOWN, "log service unavailable")
+		}
+		w := RunHandler("/busy_log", c.req.Header, nil)
+		<-logging
+		if got, want := w.Body.String(), "done"; got != want {
+			t.Errorf("failFlush=%t: response body is %q, want %q", failFlush, got, want)
+		}
+	}
+}
+
+func TestRequestSummary(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	SetRequestSummary(true)
+	defer SetRequestSummary(false)
+	http.HandleFunc("/summary", func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithContext(netcontext.Background(), r)
+		fromContext(ctx).apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+		Call(ctx, "errors", "OverQuota", &basepb.VoidProto{}, &basepb.VoidProto{})
+		Logf(ctx, 1, "to be flushed")
+		fromContext(ctx).flushLog(true) // not one of the request's calls
+	})
+	RunHandler("/summary", c.req.Header, nil)
+
+	var summary string
+	for _, msgs := range f.flushedLogs() {
+		for _, msg := range msgs {
+			if strings.HasPrefix(msg, "Request summary:") {
+				summary = msg
+			}
+		}
+	}
+	if !strings.Contains(summary, "2 API call(s)") || !strings.Contains(summary, "1 failed") {
+		t.Errorf("Request summary is %q, want 2 calls with 1 failure", summary)
+	}
+}
+
+func TestBackgroundGoroutines(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	http.HandleFunc("/background_goroutines", func(w http.ResponseWriter, r *http.Request) {
+		rc := fromContext(r.Context())
+		rc.apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		Logf(r.Context(), 1, "to be flushed")
+		rc.flushLog(true)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			RunHandler("/background_goroutines", c.req.Header, nil)
+		}()
+	}
+	wg.Wait()
+
+	quiesce()
+	if n := backgroundGoroutines(); n != 0 {
+		t.Errorf("%d background goroutines still running, want 0", n)
+	}
+}
+
+func TestGo(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	ran := make(chan *context, 1)
+	c.Go(func(gc *context) { ran <- gc })
+	if gc := <-ran; gc.parent != c || gc.Request() != c.Request() {
+		t.Errorf("Go ran the function with an unrelated context")
+	}
+
+	c.Go(func(*context) { panic("background boom") })
+	for deadline := time.Now().Add(time.Second); backgroundGoroutines() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	var logged bool
+	for _, msgs := range f.flushedLogs() {
+		for _, msg := range msgs {
+			if strings.Contains(msg, "background boom") {
+				logged = true
+			}
+		}
+	}
+	if !logged {
+		t.Error("Panic in a goroutine started with Go wasn't logged and flushed")
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	SetLogRequests(true)
+	defer SetLogRequests(false)
+	http.HandleFunc("/logged", func(w http.ResponseWriter, r *http.Request) {
+		fromContext(WithContext(netcontext.Background(), r)).apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		w.WriteHeader(http.StatusAccepted)
+	})
+	RunHandler("/logged", c.req.Header, nil)
+
+	var started, finished string
+	for _, msgs := range f.flushedLogs() {
+		for _, msg := range msgs {
+			switch {
+			case strings.HasPrefix(msg, "Request started:"):
+				started = msg
+			case strings.HasPrefix(msg, "Request finished:"):
+				finished = msg
+			}
+		}
+	}
+	if want := "Request started: GET /logged from "; !strings.HasPrefix(started, want) {
+		t.Errorf("Start of request logged as %q, want it to begin %q", started, want)
+	}
+	if want := "Request finished: status 202 in "; !strings.HasPrefix(finished, want) {
+		t.Errorf("End of request logged as %q, want it to begin %q", finished, want)
+	}
+}
+
+func TestDefer(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	var ran []int
+	var handlerDone bool
+	http.HandleFunc("/defer", func(w http.ResponseWriter, r *http.Request) {
+		rc := fromContext(r.Context())
+		rc.apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		for i := 0; i < 3; i++ {
+			i := i
+			rc.Defer(func() {
+				if !handlerDone {
+					t.Errorf("Deferred function %d ran before the handler returned", i)
+				}
+				ran = append(ran, i)
+			})
+		}
+		rc.ChildContext(time.Second).Defer(func() { panic("deferred panic") })
+		rc.Defer(func() { ran = append(ran, 3) })
+		handlerDone = true
+	})
+	RunHandler("/defer", c.req.Header, nil)
+
+	if want := []int{3, 2, 1, 0}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("Deferred functions ran in order %v, want %v", ran, want)
+	}
+	var logged bool
+	for _, msgs := range f.flushedLogs() {
+		for _, msg := range msgs {
+			if strings.Contains(msg, "deferred panic") {
+				logged = true
+			}
+		}
+	}
+	if !logged {
+		t.Error("Panic in a deferred function wasn't logged")
+	}
+}
+
+func TestRequestSummaryCounters(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	SetRequestSummary(true)
+	defer SetRequestSummary(false)
+	http.HandleFunc("/counters", func(w http.ResponseWriter, r *http.Request) {
+		rc := fromContext(WithContext(netcontext.Background(), r))
+		rc.apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		rc.IncrCounter("cache_hits", 2)
+		rc.ChildContext(time.Second).IncrCounter("cache_hits", 1)
+		rc.IncrCounter("cache_misses", 1)
+	})
+	RunHandler("/counters", c.req.Header, nil)
+
+	var summary string
+	for _, msgs := range f.flushedLogs() {
+		for _, msg := range msgs {
+			if strings.HasPrefix(msg, "Request summary:") {
+				summary = msg
+			}
+		}
+	}
+	if want := "; counters: cache_hits=3 cache_misses=1"; !strings.HasSuffix(summary, want) {
+		t.Errorf("Request summary is %q, want it to end %q", summary, want)
+	}
+}
+
+func TestSoftDeadlineRatio(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	SetSoftDeadlineRatio(0.5)
+	defer SetSoftDeadlineRatio(0)
+	call := func(timeout time.Duration) {
+		ctx := WithCallOptions(toContext(c), &CallOptions{Timeout: timeout})
+		if err := Call(ctx, "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+			t.Fatalf("API call failed: %v", err)
+		}
+	}
+	call(10 * time.Second) // well within its budget
+	call(90 * time.Millisecond)
+	if _, err := c.flushLog(false); err != nil {
+		t.Fatalf("flushLog: %v", err)
+	}
+
+	var warnings []string
+	for _, msgs := range f.flushedLogs() {
+		for _, msg := range msgs {
+			if strings.HasPrefix(msg, "API call delay.Respond took") {
+				warnings = append(warnings, msg)
+			}
+		}
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "of its 90ms timeout") {
+		t.Errorf("Got warnings %q, want one for the call with a 90ms timeout", warnings)
+	}
+}
+
+func TestLogFlushing(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	http.HandleFunc("/quick_log", func(w http.ResponseWriter, r *http.Request) {
+		logC := WithContext(netcontext.Background(), r)
+		fromContext(logC).apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		Logf(logC, 1, "It's a lovely day.")
+		w.WriteHeader(200)
+		w.Write(make([]byte, 100<<10)) // write 100 KB to force HTTP flush
+	})
+
+	r := &http.Request{
+		Method: "GET",
+		URL: &url.URL{
+			Scheme: "http",
+			Path:   "/quick_log",
+		},
+		Header: c.req.Header,
+		Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+	}
+	w := httptest.NewRecorder()
+
+	handleHTTP(w, r)
+	const hdr = "X-AppEngine-Log-Flush-Count"
+	if got, want := w.HeaderMap.Get(hdr), "1"; got != want {
+		t.Errorf("%s header = %q, want %q", hdr, got, want)
+	}
+	if got, want := atomic.LoadInt32(&f.LogFlushes), int32(1); got != want {
+		t.Errorf("After HTTP response: f.LogFlushes = %d, want %d", got, want)
+	}
+}
+
+func TestSyncLogFlush(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	if err := c.InfofSync("audit: %s", "granted"); err != nil {
+		t.Fatalf("InfofSync: %v", err)
+	}
+	if got, want := atomic.LoadInt32(&f.LogFlushes), int32(1); got != want {
+		t.Errorf("After InfofSync: f.LogFlushes = %d, want %d", got, want)
+	}
+	if err := c.ErrorfSync("audit: %s", "denied"); err != nil {
+		t.Fatalf("ErrorfSync: %v", err)
+	}
+	if got, want := atomic.LoadInt32(&f.LogFlushes), int32(2); got != want {
+		t.Errorf("After ErrorfSync: f.LogFlushes = %d, want %d", got, want)
+	}
+
+	// A failed flush is reported, and the log line is kept for later.
+	c.apiURL = &url.URL{Scheme: "http", Host: "127.0.0.1:1", Path: apiPath}
+	if err := c.InfofSync("audit: %s", "lost"); err == nil {
+		t.Error("InfofSync with unreachable API host succeeded, want error")
+	}
+	c.pendingLogs.Lock()
+	n := len(c.pendingLogs.lines)
+	c.pendingLogs.Unlock()
+	if n != 1 {
+		t.Errorf("After failed InfofSync: %d pending log lines, want 1", n)
+	}
+}
+
+func TestAbsorbLogs(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	other := &context{req: c.req, apiURL: c.apiURL}
+	start := time.Now()
+	c.AddLogRecords([]LogRecord{
+		{Time: start, Level: 1, Message: "parent 1"},
+		{Time: start.Add(2 * time.Millisecond), Level: 1, Message: "parent 2"},
+	})
+	other.AddLogRecords([]LogRecord{
+		{Time: start.Add(1 * time.Millisecond), Level: 1, Message: "other 1"},
+		{Time: start.Add(3 * time.Millisecond), Level: 1, Message: "other 2"},
+	})
+
+	c.AbsorbLogs(other)
+	if _, err := c.flushLog(false); err != nil {
+		t.Fatalf("flushLog: %v", err)
+	}
+	if got, want := atomic.LoadInt32(&f.LogFlushes), int32(1); got != want {
+		t.Errorf("Got %d log flushes, want %d", got, want)
+	}
+	want := [][]string{{"parent 1", "other 1", "parent 2", "other 2"}}
+	if got := f.flushedLogs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Flushed logs %q, want %q", got, want)
+	}
+	if flushed, _ := other.flushLog(false); flushed {
+		t.Error("Absorbed context still had logs to flush")
+	}
+}
+
+func TestOnce(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	var calls int32 // atomic
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return "geo", errors.New("partial")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.ChildContext(time.Second).Once("geo", fn)
+			if v != "geo" || err == nil || err.Error() != "partial" {
+				t.Errorf("Once = %v, %v, want geo, partial", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := c.Once("geo", fn); v != "geo" {
+		t.Errorf("Once = %v, want geo", v)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("fn ran %d times, want 1", got)
+	}
+
+	// Other keys are computed separately.
+	if v, _ := c.Once("auth", func() (interface{}, error) { return "auth", nil }); v != "auth" {
+		t.Errorf("Once with another key = %v, want auth", v)
+	}
+}
+
+func TestBufferedLogs(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	start := time.Unix(1500000000, 0)
+	want := []LogRecord{
+		{Time: start, Level: 1, Message: "first"},
+		{Time: start.Add(time.Millisecond), Level: 3, Message: "second"},
+	}
+	c.AddLogRecords(want)
+	c.ChildContext(time.Second).LogfAt(start.Add(2*time.Millisecond), 0, "from %s", "child")
+	want = append(want, LogRecord{Time: start.Add(2 * time.Millisecond), Level: 0, Message: "from child"})
+	if got := c.BufferedLogs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("BufferedLogs() = %+v, want %+v", got, want)
+	}
+
+	// Flushed lines are no longer buffered.
+	if _, err := c.flushLog(false); err != nil {
+		t.Fatalf("flushLog: %v", err)
+	}
+	if got := c.BufferedLogs(); len(got) != 0 {
+		t.Errorf("After a flush: BufferedLogs() = %+v, want none", got)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	SetFlushTimeout(10 * time.Millisecond) // the fake takes 50ms to flush
+	defer SetFlushTimeout(0)
+	logf(c, 1, "stuck")
+	logf(c, 1, "also stuck")
+	start := time.Now()
+	if _, err := c.flushLog(false); err != errTimeout {
+		t.Errorf("flushLog returned %v, want errTimeout", err)
+	}
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Errorf("Flush took %v, want it abandoned before the log service answered", d)
+	}
+	if got := c.BufferedLogs(); len(got) != 0 {
+		t.Errorf("After an abandoned flush: BufferedLogs() = %+v, want none", got)
+	}
+	c.pendingLogs.Lock()
+	dropped := c.pendingLogs.dropped
+	c.pendingLogs.Unlock()
+	if dropped != 2 {
+		t.Errorf("Dropped %d lines, want 2", dropped)
+	}
+}
+
+func TestLogfAt(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	at := time.Date(2019, 3, 14, 15, 9, 26, 535000, time.UTC)
+	c.LogfAt(at, 1, "replayed %s", "event")
+	if _, err := c.flushLog(false); err != nil {
+		t.Fatalf("flushLog: %v", err)
+	}
+	got, ok := f.flushedTime("replayed event")
+	if !ok {
+		t.Fatal("Log line wasn't flushed")
+	}
+	if !got.Equal(at) {
+		t.Errorf("Flushed log line has time %v, want %v", got.UTC(), at)
+	}
+}
+
+func TestLastFlushTime(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	if _, ok := c.LastFlushTime(); ok {
+		t.Error("Before any flush: LastFlushTime reported a flush")
+	}
+	before := time.Now()
+	if err := c.InfofSync("first"); err != nil {
+		t.Fatalf("InfofSync: %v", err)
+	}
+	first, ok := c.LastFlushTime()
+	if !ok || first.Before(before) {
+		t.Errorf("After a flush: LastFlushTime() = %v, %t, want a time after %v", first, ok, before)
+	}
+	if err := c.ChildContext(time.Second).InfofSync("second"); err != nil {
+		t.Fatalf("InfofSync: %v", err)
+	}
+	if second, _ := c.LastFlushTime(); !second.After(first) {
+		t.Errorf("After another flush: LastFlushTime() = %v, want a time after %v", second, first)
+	}
+
+	// A failed flush leaves the time alone.
+	last, _ := c.LastFlushTime()
+	c.apiURL = &url.URL{Scheme: "http", Host: "127.0.0.1:1", Path: apiPath}
+	c.InfofSync("lost")
+	if got, _ := c.LastFlushTime(); !got.Equal(last) {
+		t.Errorf("After a failed flush: LastFlushTime() = %v, want %v", got, last)
+	}
+}
+
+func TestAddLogRecords(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	c.AddLogRecords([]LogRecord{
+		{Level: 1, Message: "first"},
+		{Level: 2, Message: "second"},
+		{Level: 3, Message: "third\n"},
+	})
+	if _, err := c.flushLog(false); err != nil {
+		t.Fatalf("flushLog: %v", err)
+	}
+	flushed := f.flushedLogs()
+	if len(flushed) != 1 {
+		t.Fatalf("Got %d flushes, want 1", len(flushed))
+	}
+	if got, want := strings.Join(flushed[0], ","), "first,second,third"; got != want {
+		t.Errorf("Flushed lines = %q, want %q", got, want)
+	}
+}
+
+func TestLogBufferLimit(t *testing.T) {
+	SetMaxBufferedLogs(5)
+	defer SetMaxBufferedLogs(10000)
+
+	_, c, cleanup := setup()
+	defer cleanup()
+	for i := 0; i < 8; i++ {
+		logf(c, 1, "line %d", i)
+	}
+	c.pendingLogs.Lock()
+	var msgs []string
+	for _, ll := range c.pendingLogs.lines {
+		msgs = append(msgs, ll.GetMessage())
+	}
+	dropped := c.pendingLogs.dropped
+	c.pendingLogs.Unlock()
+	if got, want := strings.Join(msgs, ","), "line 3,line 4,line 5,line 6,line 7"; got != want {
+		t.Errorf("Buffered lines = %q, want %q", got, want)
+	}
+	if dropped != 3 {
+		t.Errorf("Dropped %d lines, want 3", dropped)
+	}
+
+	http.HandleFunc("/runaway_log", func(w http.ResponseWriter, r *http.Request) {
+		logC := fromContext(r.Context())
+		for i := 0; i < 8; i++ {
+			logf(logC, 1, "line %d", i)
+		}
+	})
+	w := RunHandler("/runaway_log", c.req.Header, nil)
+	const hdr = "X-AppEngine-Log-Truncated-Count"
+	if got, want := w.HeaderMap.Get(hdr), "3"; got != want {
+		t.Errorf("%s header = %q, want %q", hdr, got, want)
+	}
+}
+
+func TestLogBufferLimitRescue(t *testing.T) {
+	defer SetMaxBufferedLogs(10000)
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	// Lines rescued from a failed flush are subject to the limit too.
+	SetMaxBufferedLogs(5)
+	for i := 0; i < 5; i++ {
+		logf(c, 1, "line %d", i)
+	}
+	SetMaxBufferedLogs(3)
+	f.respondWithRPCError("logservice", "Flush", remotepb.RpcError_UNKNOWN, "flush failed")
+	if _, err := c.flushLog(true); err == nil {
+		t.Fatal("flushLog succeeded, want the injected error")
+	}
+	c.pendingLogs.Lock()
+	n, dropped := len(c.pendingLogs.lines), c.pendingLogs.dropped
+	c.pendingLogs.Unlock()
+	if n != 3 || dropped != 2 {
+		t.Errorf("After a failed flush, %d lines buffered and %d dropped, want 3 and 2", n, dropped)
+	}
+}
+
+func TestLogBufferUnlimited(t *testing.T) {
+	defer SetMaxBufferedLogs(10000)
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	for _, max := range []int{0, -1} {
+		SetMaxBufferedLogs(max)
+		c.pendingLogs.Lock()
+		c.pendingLogs.lines, c.pendingLogs.dropped = nil, 0
+		c.pendingLogs.Unlock()
+		for i := 0; i < 20; i++ {
+			logf(c, 1, "line %d", i)
+		}
+		c.pendingLogs.Lock()
+		n, dropped := len(c.pendingLogs.lines), c.pendingLogs.dropped
+		c.pendingLogs.Unlock()
+		if n != 20 || dropped != 0 {
+			t.Errorf("SetMaxBufferedLogs(%d): %d lines buffered and %d dropped, want 20 and 0", max, n, dropped)
+		}
+	}
+}
+
+// RunHandler serves a request for path with the given headers and body
+// through handleHTTP, and returns the recorded response.
+// The request is a GET if body is nil, and a POST otherwise.
+func RunHandler(path string, headers http.Header, body []byte) *httptest.ResponseRecorder {
+	method := "GET"
+	if body != nil {
+		method = "POST"
+	}
+	if headers == nil {
+		headers = http.Header{}
+	}
+	r := &http.Request{
+		Method:        method,
+		URL:           &url.URL{Scheme: "http", Path: path},
+		Header:        headers,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	w := httptest.NewRecorder()
+	handleHTTP(w, r)
+	return w
+}
+
+// quiesce waits for the requests being served to finish, along with the
+// flushing of their logs and any other background goroutines, so that tests
+// don't affect each other. It then clears what the package accumulates across
+// requests, ends any drain, and removes the method policy and the hooks and
+// overrides installed with the package's Set functions. Settings that default
+// to something else, such as limits and header names, are left for the tests
+// that change them to restore. Tests that serve requests in the background
+// call it on teardown.
+func quiesce() {
+	requestsInFlight.Lock()
+	for requestsInFlight.n > 0 {
+		requestsIdle.Wait()
+	}
+	requestsInFlight.Unlock()
+	// The background goroutines of finished requests take a moment to exit.
+	for deadline := time.Now().Add(time.Second); backgroundGoroutines() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+
+	callStats.Lock()
+	callStats.m = make(map[StatKey]*CallStat)
+	callStats.Unlock()
+	dedupCache.Lock()
+	dedupCache.m = make(map[dedupKey]dedupEntry)
+	dedupCache.Unlock()
+	staleCache.Lock()
+	staleCache.m = make(map[staleKey]staleEntry)
+	staleCache.Unlock()
+	slowCalls.Lock()
+	for i := range slowCalls.ring {
+		slowCalls.ring[i] = SlowCallSample{}
+	}
+	slowCalls.next, slowCalls.full = 0, false
+	slowCalls.Unlock()
+	counterTotals.Lock()
+	counterTotals.m = nil
+	counterTotals.Unlock()
+	resetDrain()
+
+	methodPolicy.Lock()
+	methodPolicy.denied = make(map[methodKey]bool)
+	methodPolicy.Unlock()
+	SetAPIResolver(nil)
+	SetAPIPath("")
+	SetCallRewriter(nil)
+	SetErrorMapper(nil)
+	SetDeadlineOverride(nil)
+	SetSoftDeadlineRatio(0)
+	SetInboundVerifier(nil)
+	SetStatsFlusher(nil)
+}
+
+func TestQuiesce(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	called := make(chan struct{})
+	http.HandleFunc("/background", func(w http.ResponseWriter, r *http.Request) {
+		ctx := WithContext(netcontext.Background(), r)
+		fromContext(ctx).apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		Logf(ctx, 1, "It's a lovely day.")
+		fromContext(ctx).IncrCounter("lookups", 1)
+		opts := &CallOptions{IdempotencyKey: "quiesce", ServeStaleOnError: true}
+		Call(WithCallOptions(ctx, opts), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+		close(called)
+	})
+	go RunHandler("/background", c.req.Header, nil)
+	<-called // the request is still to finish and flush its logs
+
+	recordSlowCall(&CallInfo{Service: "actordb", Method: "LookupActor", Duration: time.Minute}, time.Now())
+	atomic.StoreInt32(&draining, 1)
+	SetMethodPolicy("actordb", "LookupActor", false)
+	SetAPIResolver(func() (string, string, error) { return c.apiURL.Hostname(), c.apiURL.Port(), nil })
+	SetAPIPath("/elsewhere")
+	SetCallRewriter(func(service, method string) (string, string) { return service, method })
+	SetErrorMapper(func(err *CallError) error { return err })
+	SetDeadlineOverride(func(service, method string, deadline time.Time) time.Time { return deadline })
+	SetSoftDeadlineRatio(0.5)
+	SetInboundVerifier(func(*http.Request) error { return nil })
+	SetStatsFlusher(func(map[StatKey]CallStat) {})
+
+	quiesce()
+	if got := atomic.LoadInt32(&f.LogFlushes); got != 1 {
+		t.Errorf("After quiesce: %d log flushes, want the request's final flush", got)
+	}
+	if n := len(CallStats()); n != 0 {
+		t.Errorf("After quiesce: %d call stats, want none", n)
+	}
+	dedupCache.Lock()
+	nd := len(dedupCache.m)
+	dedupCache.Unlock()
+	staleCache.Lock()
+	ns := len(staleCache.m)
+	staleCache.Unlock()
+	if nd != 0 || ns != 0 {
+		t.Errorf("After quiesce: %d deduplicated and %d stale responses, want none", nd, ns)
+	}
+	if n := len(SlowCalls()); n != 0 {
+		t.Errorf("After quiesce: %d slow calls, want none", n)
+	}
+	if n := len(currentDiagnostics().Counters); n != 0 {
+		t.Errorf("After quiesce: %d counter totals, want none", n)
+	}
+	if atomic.LoadInt32(&draining) != 0 {
+		t.Error("After quiesce: still draining")
+	}
+	if err := checkMethodPolicy("actordb", "LookupActor"); err != nil {
+		t.Errorf("After quiesce: method policy still denies the call: %v", err)
+	}
+	if _, ok, _ := resolveAPIURL(); ok {
+		t.Error("After quiesce: the API resolver is still installed")
+	}
+	if got := currentAPIPath(); got != apiPath {
+		t.Errorf("After quiesce: API path is %q, want the default", got)
+	}
+	callRewriter.RLock()
+	rewriter := callRewriter.f != nil
+	callRewriter.RUnlock()
+	errorMapper.RLock()
+	mapper := errorMapper.f != nil
+	errorMapper.RUnlock()
+	deadlineOverride.RLock()
+	override := deadlineOverride.f != nil
+	deadlineOverride.RUnlock()
+	softDeadlineRatio.RLock()
+	ratio := softDeadlineRatio.r
+	softDeadlineRatio.RUnlock()
+	inboundVerifier.RLock()
+	verifier := inboundVerifier.f != nil
+	inboundVerifier.RUnlock()
+	statsFlusher.RLock()
+	flusher := statsFlusher.f != nil
+	statsFlusher.RUnlock()
+	if rewriter || mapper || override || ratio != 0 || verifier || flusher {
+		t.Errorf("After quiesce: rewriter %v, error mapper %v, deadline override %v, soft deadline ratio %v, inbound verifier %v, stats flusher %v; want none",
+			rewriter, mapper, override, ratio, verifier, flusher)
+	}
+}
+
+func TestRunHandler(t *testing.T) {
+	http.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "%s %s", r.Header.Get("X-Greeting"), body)
+	})
+
+	w := RunHandler("/echo", http.Header{"X-Greeting": []string{"hello"}}, []byte("world"))
+	if w.Code != http.StatusCreated {
+		t.Errorf("Got HTTP %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got, want := w.HeaderMap.Get("X-Method"), "POST"; got != want {
+		t.Errorf("Request method = %q, want %q", got, want)
+	}
+	if got, want := w.Body.String(), "hello world"; got != want {
+		t.Errorf("Body = %q, want %q", got, want)
+	}
+}
+
+func TestSoftErrors(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	http.HandleFunc("/soft_errors", func(w http.ResponseWriter, r *http.Request) {
+		ac := fromContext(r.Context())
+		ac.apiURL = c.apiURL
+		ac.RecordSoftError(errors.New("cache miss"))
+		ac.ChildContext(time.Second).RecordSoftError(errors.New("recommendations unavailable"))
+		if n := len(ac.SoftErrors()); n != 2 {
+			t.Errorf("Got %d soft errors, want 2", n)
+		}
+	})
+	RunHandler("/soft_errors", c.req.Header, nil)
+
+	var logged []string
+	for _, msgs := range f.flushedLogs() {
+		logged = append(logged, msgs...)
+	}
+	want := "2 soft error(s) during request: cache miss; recommendations unavailable"
+	if len(logged) != 1 || logged[0] != want {
+		t.Errorf("Logged %q, want [%q]", logged, want)
+	}
+}
+
+func TestRemoteAddr(t *testing.T) {
+	var addr string
 	http.HandleFunc("/remote_addr", func(w http.ResponseWriter, r *http.Request) {
 		addr = r.RemoteAddr
 	})
@@ -347,16 +2938,35 @@ func TestRemoteAddr(t *testing.T) {
 			"[::1]:http",
 		},
 		{http.Header{}, "127.0.0.1:80"},
+		// X-Appengine-Remote-Addr takes precedence.
+		{
+			http.Header{
+				"X-Appengine-User-Ip":     []string{"10.5.2.1"},
+				"X-Appengine-Remote-Addr": []string{"1.2.3.4"},
+			},
+			"1.2.3.4:80",
+		},
+		// Malformed values are trimmed, or ignored.
+		{http.Header{"X-Appengine-Remote-Addr": []string{" 1.2.3.4 "}}, "1.2.3.4:80"},
+		{
+			http.Header{
+				"X-Appengine-User-Ip":     []string{"10.5.2.1"},
+				"X-Appengine-Remote-Addr": []string{""},
+			},
+			"10.5.2.1:80",
+		},
+		{
+			http.Header{
+				"X-Appengine-User-Ip":     []string{"10.5.2.1"},
+				"X-Appengine-Remote-Addr": []string{"not an address"},
+			},
+			"10.5.2.1:80",
+		},
+		{http.Header{"X-Appengine-User-Ip": []string{"   "}}, "127.0.0.1:80"},
 	}
 
 	for _, tc := range testCases {
-		r := &http.Request{
-			Method: "GET",
-			URL:    &url.URL{Scheme: "http", Path: "/remote_addr"},
-			Header: tc.headers,
-			Body:   ioutil.NopCloser(bytes.NewReader(nil)),
-		}
-		handleHTTP(httptest.NewRecorder(), r)
+		RunHandler("/remote_addr", tc.headers, nil)
 		if addr != tc.addr {
 			t.Errorf("Header %v, got %q, want %q", tc.headers, addr, tc.addr)
 		}
@@ -0,0 +1,47 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file runs work in the background of requests, keeping count of the
+// goroutines doing it so that tests can check that none are leaked.
+
+import "sync/atomic"
+
+var bgGoroutines int32 // atomic
+
+// goBackground runs f in a goroutine of its own, which is counted by
+// backgroundGoroutines until f returns.
+func goBackground(f func()) {
+	atomic.AddInt32(&bgGoroutines, 1)
+	go func() {
+		defer atomic.AddInt32(&bgGoroutines, -1)
+		f()
+	}()
+}
+
+// backgroundGoroutines returns the number of goroutines started by
+// goBackground that are still running. The log flusher of the background
+// context, which runs for the life of the process, isn't one of them.
+func backgroundGoroutines() int {
+	return int(atomic.LoadInt32(&bgGoroutines))
+}
+
+// Go runs fn in a goroutine of its own with a context derived from c, as by
+// ChildContext but with no deadline beyond c's. A panic in fn is logged, and
+// the logs flushed, rather than crashing the instance.
+func (c *context) Go(fn func(c *context)) {
+	child := c.child(c.deadline)
+	goBackground(func() {
+		defer func() {
+			if x := recover(); x != nil {
+				logf(child, 4, "%s", renderPanic(x)) // 4 == critical
+				child.flushLog(false)
+			}
+		}()
+		fn(child)
+	})
+}
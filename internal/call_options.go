@@ -0,0 +1,173 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	netcontext "golang.org/x/net/context"
+)
+
+// CallOptions holds per-call settings that modify how Call dispatches
+// an API call. Use WithCallOptions to apply them to calls made with a context.
+type CallOptions struct {
+	// IdempotencyKey identifies calls that have the same effect when repeated.
+	// If a call with the same service, method, key and request message
+	// succeeded recently, Call returns the recorded response instead of
+	// dispatching it again; reusing the key for a different request message
+	// fails with a BAD_REQUEST *CallError. Messages with map fields should be
+	// encoded with Deterministic set, so that equal requests compare equal.
+	// Only successful calls are recorded, and only by this process: a call
+	// whose response was lost in transit may already have taken effect, and
+	// retrying it, such as with Retries, dispatches it again.
+	IdempotencyKey string
+
+	// Timeout limits how long the call may take. The call still has to
+	// finish within the deadline of the context, if that is sooner.
+	Timeout time.Duration
+
+	// Deterministic makes the request message encode to the same bytes
+	// every time, such as for signing or caching.
+	Deterministic bool
+
+	// Attachment is an opaque blob sent alongside the request message
+	// for services that accept one.
+	Attachment []byte
+
+	// ResponseAttachment, if non-nil, is set to the blob the service
+	// returned alongside its response, if any.
+	ResponseAttachment *[]byte
+
+	// Headers are added to the headers of the service bridge request.
+	// Headers that calls set themselves, such as those for tracing and
+	// those of the service bridge protocol, are left out.
+	Headers http.Header
+
+	// AcceptCodes are codes of application errors, as in APIError.Code,
+	// that the caller takes to be normal outcomes of the call, such as
+	// an entity not being found. A call failing with one of them succeeds
+	// without setting its response message.
+	AcceptCodes []int32
+
+	// ResultCode, if non-nil, is set to the code of the accepted
+	// application error that a call succeeded with, or to zero if the
+	// service returned a response.
+	ResultCode *int32
+
+	// IfNoneMatch makes the call conditional: it is the tag of the response
+	// the caller already has, and the service may answer that the response
+	// is unchanged rather than send it again.
+	IfNoneMatch string
+
+	// NotModified, if non-nil, is set to whether the service answered a
+	// call with IfNoneMatch set that its response is unchanged. If it did,
+	// the call succeeds without setting its response message.
+	NotModified *bool
+
+	// OnComplete, if non-nil, is called with the details of the call
+	// once it has completed.
+	OnComplete func(CallInfo)
+
+	// LogCallID causes the call's ID and outcome to be logged at debug level.
+	LogCallID bool
+
+	// ValidateResponse, if non-nil, is called with the response message
+	// after it has been decoded. If it returns an error, the call fails
+	// with a *CallError describing it.
+	ValidateResponse func(out proto.Message) error
+
+	// Retries is the number of times a call that fails with a transient
+	// *CallError, one with code UNKNOWN or CANCELLED other than a timeout,
+	// is attempted again. The response message is reset before each retry,
+	// so it never holds data from a failed attempt.
+	Retries int
+
+	// MinBudget is the least time a call may be given to finish. A call
+	// whose timeout is less, as when little of the request's time budget
+	// remains, fails at once with a CANCELLED *CallError.
+	MinBudget time.Duration
+
+	// EscalatingDeadlines, if non-empty, are the timeouts of successive
+	// attempts of the call, overriding Timeout: the call is attempted with
+	// each in turn for as long as its attempts time out. Retries are made
+	// after these attempts, with Timeout as usual.
+	EscalatingDeadlines []time.Duration
+
+	// ServeStaleOnError causes a call that fails with a *CallError to
+	// succeed with the last good response to the same request, if there
+	// is one no older than SetMaxStaleness allows. The failure is recorded
+	// as a soft error of the request, and CallInfo.Stale is set.
+	ServeStaleOnError bool
+
+	// SkipInterceptors causes the call to be dispatched directly, without
+	// running the functions installed with WithCallOverride. An override
+	// can use it to make calls of its own with the context it intercepts.
+	SkipInterceptors bool
+
+	// StatTags are dimensions, such as the endpoint being served,
+	// by which the call is counted separately in CallStats.
+	StatTags map[string]string
+
+	// ParentSpanID, if set, replaces the span ID in the trace context
+	// forwarded with the call, so that the backend records the call as
+	// a child of that span rather than of the inbound request.
+	ParentSpanID string
+
+	// RequireNonEmptyResponse causes the call to fail with a *CallError
+	// if the service returns an empty response, unless the response
+	// message is a VoidProto.
+	RequireNonEmptyResponse bool
+
+	// FreshConnection causes the call to be made on a new connection,
+	// which is closed afterwards, rather than on a pooled one.
+	FreshConnection bool
+
+	// MaxResponseSize, if positive, is the size in bytes of the largest
+	// response message the call accepts. The call fails with a *CallError
+	// if the service returns a larger one.
+	MaxResponseSize int64
+
+	// BackendShard, if set, routes the call to the named shard of the
+	// service's backend, rather than letting the bridge choose, such as
+	// for debugging a misbehaving shard.
+	BackendShard string
+
+	// Ticket, if set, is the security ticket the call is made with,
+	// in place of that of the inbound request, such as for a call made
+	// on behalf of another tenant. It must not be blank.
+	Ticket string
+
+	// OmitTicket causes the call to be made without a security ticket,
+	// for services that don't require one. Ticket is then ignored.
+	OmitTicket bool
+
+	// CorrelateLogs causes logs written with the call's context while the
+	// call is in progress, such as by a function installed with
+	// WithCallOverride, to be tagged with the call's ID and service,
+	// as are the lines the package logs about the call itself.
+	CorrelateLogs bool
+}
+
+var callOptionsKey = "holds a *CallOptions"
+
+// noCallOptions is used when a context carries no call options.
+// It must not be modified.
+var noCallOptions = &CallOptions{}
+
+// WithCallOptions returns a copy of ctx in which calls are made with opts.
+func WithCallOptions(ctx netcontext.Context, opts *CallOptions) netcontext.Context {
+	return netcontext.WithValue(ctx, &callOptionsKey, opts)
+}
+
+func callOptionsFromContext(ctx netcontext.Context) *CallOptions {
+	if opts, ok := ctx.Value(&callOptionsKey).(*CallOptions); ok && opts != nil {
+		return opts
+	}
+	return noCallOptions
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package internal
+
+// This file has code for decoding compressed service bridge responses.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxDecompressedSize is the most a compressed response may expand to.
+// It protects against decompression bombs.
+var maxDecompressedSize int64 = 64 << 20
+
+// decodeResponse returns a reader of the body of hresp with the
+// Content-Encoding, if any, removed, along with the name of the encoding.
+// The encodings are those advertised in apiAcceptEncodingValue.
+func decodeResponse(hresp *http.Response) (enc string, body io.Reader, err error) {
+	enc = strings.ToLower(strings.TrimSpace(hresp.Header.Get("Content-Encoding")))
+	switch enc {
+	case "", "identity":
+		return "", hresp.Body, nil
+	case "gzip":
+		body, err = gzip.NewReader(hresp.Body)
+	case "deflate":
+		// HTTP's deflate encoding is the zlib format.
+		body, err = zlib.NewReader(hresp.Body)
+	default:
+		return "", nil, fmt.Errorf("unsupported Content-Encoding %q", enc)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", enc, err)
+	}
+	return enc, body, nil
+}
+
+// isGzip reports whether b starts with the gzip magic number.
+// An encoded remote_api.Response never does, as 0x1f would be an
+// invalid field tag.
+func isGzip(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// gunzip decompresses b, failing if the result exceeds maxDecompressedSize.
+func gunzip(b []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return readLimited(zr, maxDecompressedSize)
+}
+
+// readLimited reads all of r, failing if it holds more than limit bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("decompressed response exceeds %d bytes", limit)
+	}
+	return b, nil
+}
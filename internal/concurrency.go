@@ -0,0 +1,70 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements a request-scoped cap on concurrent API calls.
+
+import (
+	"time"
+
+	netcontext "golang.org/x/net/context"
+)
+
+// SetMaxConcurrentCalls limits the number of calls made with c, or contexts
+// derived from it, that may be in flight at once to n. Calls beyond that wait
+// for a call to finish, failing if none does before their deadline.
+// An n of zero or less removes the limit. Calls already in flight when the
+// limit changes count against the limit they started under.
+func SetMaxConcurrentCalls(c *context, n int) {
+	if c.parent != nil {
+		c = c.parent
+	}
+	var slots chan struct{}
+	if n > 0 {
+		slots = make(chan struct{}, n)
+	}
+	c.callSlots.Lock()
+	c.callSlots.ch = slots
+	c.callSlots.Unlock()
+}
+
+// acquireCallSlot waits until a call may be made with c under the limit set
+// with SetMaxConcurrentCalls, if any. The caller must call release once the
+// call has finished.
+func (c *context) acquireCallSlot(ctx netcontext.Context) (release func(), err error) {
+	root := c
+	if c.parent != nil {
+		root = c.parent
+	}
+	root.callSlots.Lock()
+	slots := root.callSlots.ch
+	root.callSlots.Unlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+	release = func() { <-slots }
+
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	var expired <-chan time.Time
+	if deadline := c.waitDeadline(ctx); !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-expired:
+		return nil, errTimeout
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package internal
+
+// This file implements a short-lived record of successful idempotent calls,
+// so that repeating a call that succeeded doesn't dispatch it twice.
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	remotepb "google.golang.org/appengine/internal/remote_api"
+)
+
+// dedupWindow is how long a successful idempotent call is remembered.
+const dedupWindow = 30 * time.Second
+
+type dedupKey struct {
+	service, method, key string
+}
+
+type dedupEntry struct {
+	request  [sha256.Size]byte // hash of the encoded request message
+	response []byte
+	expires  time.Time
+}
+
+var dedupCache = struct {
+	sync.Mutex
+	m map[dedupKey]dedupEntry
+}{m: make(map[dedupKey]dedupEntry)}
+
+// dedupLookup returns the recorded response of a recent successful call
+// with the given key and encoded request message. It fails if the key was
+// used for a different request, whose response can't stand in for this one.
+func dedupLookup(k dedupKey, request []byte) ([]byte, bool, error) {
+	dedupCache.Lock()
+	defer dedupCache.Unlock()
+	e, ok := dedupCache.m[k]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(e.expires) {
+		delete(dedupCache.m, k)
+		return nil, false, nil
+	}
+	if e.request != sha256.Sum256(request) {
+		return nil, false, &CallError{
+			Detail: fmt.Sprintf("idempotency key %q reused for a different request", k.key),
+			Code:   int32(remotepb.RpcError_BAD_REQUEST),
+		}
+	}
+	return e.response, true, nil
+}
+
+// dedupRecord records the response of a successful call with the given key
+// and encoded request message.
+func dedupRecord(k dedupKey, request, response []byte) {
+	now := time.Now()
+	dedupCache.Lock()
+	defer dedupCache.Unlock()
+	for k, e := range dedupCache.m {
+		if now.After(e.expires) {
+			delete(dedupCache.m, k)
+		}
+	}
+	dedupCache.m[k] = dedupEntry{
+		request:  sha256.Sum256(request),
+		response: response,
+		expires:  now.Add(dedupWindow),
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements cleanup functions that run at the end of a request.
+
+// Defer registers fn to be called when c's request finishes, after its
+// handler returns and before its logs are last flushed. The functions are
+// called in the reverse of the order they were registered in. A function
+// that panics is logged, and the others are still called. Functions
+// registered once the request has finished are never called.
+func (c *context) Defer(fn func()) {
+	if c.parent != nil {
+		c = c.parent
+	}
+	c.deferred.Lock()
+	c.deferred.fns = append(c.deferred.fns, fn)
+	c.deferred.Unlock()
+}
+
+// runDeferred calls the functions registered with Defer for c's request.
+func (c *context) runDeferred() {
+	c.deferred.Lock()
+	fns := c.deferred.fns
+	c.deferred.fns = nil
+	c.deferred.Unlock()
+	for i := len(fns) - 1; i >= 0; i-- {
+		c.callDeferred(fns[i])
+	}
+}
+
+func (c *context) callDeferred(fn func()) {
+	defer func() {
+		if x := recover(); x != nil {
+			logf(c, 3, "Deferred function panicked: %s", renderPanic(x)) // error level
+		}
+	}()
+	fn()
+}
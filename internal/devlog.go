@@ -0,0 +1,62 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements JSON logging to stdout under the development server.
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var devJSONLogging int32 // atomic; 1 if enabled
+
+// devJSONOut is where JSON log lines are written. Writes are serialized so
+// that lines logged concurrently aren't interleaved.
+var devJSONOut = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stdout}
+
+// SetDevJSONLogging controls whether, under the development server, each
+// log line is also written to stdout as a JSON object, for log tooling.
+// It is disabled by default.
+func SetDevJSONLogging(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&devJSONLogging, v)
+}
+
+type devLogEntry struct {
+	Timestamp string `json:"timestamp"`
+	Severity  string `json:"severity"`
+	Message   string `json:"message"`
+}
+
+// writeDevJSON writes a log line as enabled by SetDevJSONLogging, if it is.
+func writeDevJSON(t time.Time, level int64, msg string) {
+	if atomic.LoadInt32(&devJSONLogging) == 0 || !IsDevAppServer() {
+		return
+	}
+	b, err := json.Marshal(devLogEntry{
+		Timestamp: t.UTC().Format(time.RFC3339Nano),
+		Severity:  logLevelName[level],
+		Message:   msg,
+	})
+	if err != nil {
+		return
+	}
+	devJSONOut.Lock()
+	defer devJSONOut.Unlock()
+	devJSONOut.w.Write(append(b, '\n'))
+}
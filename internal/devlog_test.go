@@ -0,0 +1,62 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDevJSONLogging(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	var buf bytes.Buffer
+	devJSONOut.Lock()
+	devJSONOut.w = &buf
+	devJSONOut.Unlock()
+	defer func() {
+		devJSONOut.Lock()
+		devJSONOut.w = os.Stdout
+		devJSONOut.Unlock()
+	}()
+	setDevAppServer := func(is bool) {
+		devAppServerOnce = sync.Once{}
+		devAppServerOnce.Do(func() { devAppServer = is })
+	}
+	defer func() { devAppServerOnce = sync.Once{} }()
+
+	// Nothing is written unless enabled, and under the development server.
+	setDevAppServer(true)
+	logf(c, 1, "not enabled")
+	SetDevJSONLogging(true)
+	defer SetDevJSONLogging(false)
+	setDevAppServer(false)
+	logf(c, 1, "not the development server")
+	if buf.Len() != 0 {
+		t.Errorf("Wrote %q, want nothing", buf.String())
+	}
+
+	setDevAppServer(true)
+	at := time.Date(2019, 3, 14, 15, 9, 26, 0, time.UTC)
+	c.LogfAt(at, 2, "disk %d%% full", 93)
+	var entry devLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Bad JSON log line %q: %v", buf.String(), err)
+	}
+	want := devLogEntry{Timestamp: "2019-03-14T15:09:26Z", Severity: "WARNING", Message: "disk 93% full"}
+	if entry != want {
+		t.Errorf("Logged %+v, want %+v", entry, want)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("}\n")) {
+		t.Errorf("Log line %q isn't terminated by a newline", buf.String())
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements a handler reporting the state of the API machinery
+// of the instance, for debugging.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+type diagnostics struct {
+	Calls            []callDiagnostics     `json:"calls"`
+	RequestsInFlight int                   `json:"requests_in_flight"`
+	PendingLogs      int                   `json:"pending_logs"`
+	Connections      connectionDiagnostics `json:"api_connections"`
+	Counters         map[string]int64      `json:"counters"`
+}
+
+type callDiagnostics struct {
+	Service string  `json:"service"`
+	Method  string  `json:"method"`
+	Tags    string  `json:"tags,omitempty"`
+	Calls   int64   `json:"calls"`
+	Errors  int64   `json:"errors"`
+	Seconds float64 `json:"seconds"`
+}
+
+type connectionDiagnostics struct {
+	Open int `json:"open"`
+	Max  int `json:"max"`
+}
+
+// DiagnosticsHandler returns a handler that reports, as JSON, the counters
+// returned by CallStats, the requests in flight and the log lines they have
+// yet to flush, the connections open to the API host, and the totals of the
+// counters kept with IncrCounter.
+// It is meant to be mounted at an internal path for debugging the instance.
+func DiagnosticsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(currentDiagnostics())
+	})
+}
+
+func currentDiagnostics() *diagnostics {
+	d := &diagnostics{
+		Calls: []callDiagnostics{},
+		Connections: connectionDiagnostics{
+			Open: len(limitSem),
+			Max:  cap(limitSem),
+		},
+	}
+	for k, s := range CallStats() {
+		d.Calls = append(d.Calls, callDiagnostics{
+			Service: k.Service,
+			Method:  k.Method,
+			Tags:    k.Tags,
+			Calls:   s.Calls,
+			Errors:  s.Errors,
+			Seconds: s.Time.Seconds(),
+		})
+	}
+	sort.Slice(d.Calls, func(i, j int) bool {
+		a, b := d.Calls[i], d.Calls[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Tags < b.Tags
+	})
+
+	counterTotals.Lock()
+	d.Counters = make(map[string]int64, len(counterTotals.m))
+	for name, n := range counterTotals.m {
+		d.Counters[name] = n
+	}
+	counterTotals.Unlock()
+
+	requestsInFlight.Lock()
+	d.RequestsInFlight = requestsInFlight.n
+	for c := range requestsInFlight.contexts {
+		c.pendingLogs.Lock()
+		d.PendingLogs += len(c.pendingLogs.lines)
+		c.pendingLogs.Unlock()
+	}
+	requestsInFlight.Unlock()
+	return d
+}
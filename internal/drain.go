@@ -0,0 +1,97 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements draining the instance before it shuts down.
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	draining      int32 // atomic; 1 once BeginDrain has been called
+	callsInFlight int32 // atomic; number of calls being made by Call or CallStream
+)
+
+// callsIdle wakes BeginDrain when the last call in flight ends.
+var callsIdle = make(chan struct{}, 1)
+
+// drainTimeout is how long BeginDrain waits for calls in flight.
+var drainTimeout = 10 * time.Second
+
+var errDraining = errors.New("API call rejected: instance is draining")
+
+// BeginDrain prepares the instance to shut down, such as on SIGTERM.
+// API calls made after it is called fail, except for log flushes.
+// It waits for the calls in flight to finish, for up to 10 seconds,
+// and then flushes the logs of the requests in flight and passes the
+// counters returned by CallStats to the function set by SetStatsFlusher.
+// It returns an error if calls were still in flight when it gave up waiting.
+func BeginDrain() error {
+	atomic.StoreInt32(&draining, 1)
+
+	var err error
+	timer := time.NewTimer(drainTimeout)
+	defer timer.Stop()
+wait:
+	for atomic.LoadInt32(&callsInFlight) != 0 {
+		select {
+		case <-callsIdle:
+		case <-timer.C:
+			err = fmt.Errorf("draining: %d API call(s) still in flight after %v", atomic.LoadInt32(&callsInFlight), drainTimeout)
+			break wait
+		}
+	}
+	DrainLogs()
+	flushStats()
+	return err
+}
+
+// endCall records the end of a call counted in callsInFlight,
+// waking BeginDrain if it was the last.
+func endCall() {
+	if atomic.AddInt32(&callsInFlight, -1) == 0 && atomic.LoadInt32(&draining) != 0 {
+		select {
+		case callsIdle <- struct{}{}:
+		default: // BeginDrain is woken already
+		}
+	}
+}
+
+// resetDrain undoes BeginDrain, for tests.
+func resetDrain() {
+	atomic.StoreInt32(&draining, 0)
+	select {
+	case <-callsIdle:
+	default:
+	}
+}
+
+// isDraining reports whether a call to service.method must be rejected
+// because the instance is draining.
+func isDraining(service, method string) bool {
+	if atomic.LoadInt32(&draining) == 0 {
+		return false
+	}
+	return !isLogFlush(service, method)
+}
+
+// DrainLogs flushes the logs buffered by all the requests in flight.
+func DrainLogs() {
+	requestsInFlight.Lock()
+	cs := make([]*context, 0, len(requestsInFlight.contexts))
+	for c := range requestsInFlight.contexts {
+		cs = append(cs, c)
+	}
+	requestsInFlight.Unlock()
+	for _, c := range cs {
+		c.flushLog(false)
+	}
+}
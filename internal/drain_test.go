@@ -0,0 +1,81 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+import (
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	basepb "google.golang.org/appengine/internal/base"
+)
+
+func TestBeginDrain(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+	defer resetDrain()
+	flushed := make(chan map[StatKey]CallStat, 1)
+	SetStatsFlusher(func(stats map[StatKey]CallStat) { flushed <- stats })
+	defer SetStatsFlusher(nil)
+	key := StatKey{Service: "delay", Method: "Respond"}
+	before := CallStats()[key].Calls
+
+	inFlight := make(chan error)
+	go func() {
+		inFlight <- Call(toContext(c), "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{})
+	}()
+	for atomic.LoadInt32(&callsInFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error)
+	go func() { done <- BeginDrain() }()
+	for atomic.LoadInt32(&draining) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := Call(toContext(c), "actordb", "Lookup", &basepb.VoidProto{}, &basepb.VoidProto{}); err != errDraining {
+		t.Errorf("Call while draining returned %v, want errDraining", err)
+	}
+	if err := c.CallStream("actordb", "Lookup", &basepb.VoidProto{}, ioutil.Discard, nil); err != errDraining {
+		t.Errorf("CallStream while draining returned %v, want errDraining", err)
+	}
+	if err := <-inFlight; err != nil {
+		t.Errorf("Call in flight when draining began failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("BeginDrain: %v", err)
+	}
+	select {
+	case stats := <-flushed:
+		if n := stats[key].Calls - before; n != 1 {
+			t.Errorf("Flushed stats count %d more delay.Respond call(s), want 1", n)
+		}
+	default:
+		t.Error("BeginDrain didn't flush the stats")
+	}
+}
+
+func TestBeginDrainTimeout(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+	defer resetDrain()
+	defer func(d time.Duration) { drainTimeout = d }(drainTimeout)
+	drainTimeout = 10 * time.Millisecond
+
+	inFlight := make(chan error)
+	go func() {
+		inFlight <- Call(toContext(c), "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{})
+	}()
+	for atomic.LoadInt32(&callsInFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := BeginDrain(); err == nil {
+		t.Error("BeginDrain returned no error with a call still in flight")
+	}
+	<-inFlight
+}
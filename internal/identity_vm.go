@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	netcontext "golang.org/x/net/context"
 )
@@ -36,6 +37,12 @@ func DefaultVersionHostname(ctx netcontext.Context) string {
 	return ctxHeaders(ctx).Get(hDefaultVersionHostname)
 }
 
+// DefaultVersionHostname returns the hostname of the default version of the
+// app, as given on the inbound request, or the empty string if it wasn't.
+func (c *context) DefaultVersionHostname() string {
+	return c.defaultVersionHostname
+}
+
 func RequestID(ctx netcontext.Context) string {
 	return ctxHeaders(ctx).Get(hRequestLogId)
 }
@@ -129,6 +136,39 @@ func fullyQualifiedAppID(_ netcontext.Context) string {
 	return appID
 }
 
+var (
+	devAppServerOnce sync.Once
+	devAppServer     bool
+)
+
+// IsDevAppServer reports whether the app is running under the local
+// development server, as set by RUN_WITH_DEVAPPSERVER. The environment
+// is inspected only once.
 func IsDevAppServer() bool {
-	return os.Getenv("RUN_WITH_DEVAPPSERVER") != ""
+	devAppServerOnce.Do(func() {
+		devAppServer = os.Getenv("RUN_WITH_DEVAPPSERVER") != ""
+	})
+	return devAppServer
+}
+
+var servingRegion struct {
+	sync.Mutex
+	known  bool
+	region string
+}
+
+// ServingRegion returns the region the app is serving from, such as
+// "us-central1", as given by the environment, or the empty string if it
+// isn't given. The environment is inspected only once.
+func ServingRegion() string {
+	servingRegion.Lock()
+	defer servingRegion.Unlock()
+	if !servingRegion.known {
+		servingRegion.region = os.Getenv("GAE_REGION")
+		if servingRegion.region == "" {
+			servingRegion.region = os.Getenv("GOOGLE_CLOUD_REGION")
+		}
+		servingRegion.known = true
+	}
+	return servingRegion.region
 }
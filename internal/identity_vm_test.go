@@ -0,0 +1,46 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestIsDevAppServer(t *testing.T) {
+	defer os.Setenv("RUN_WITH_DEVAPPSERVER", os.Getenv("RUN_WITH_DEVAPPSERVER"))
+	defer os.Setenv("API_HOST", os.Getenv("API_HOST"))
+	reset := func() { devAppServerOnce = sync.Once{} }
+	defer reset()
+
+	testCases := []struct {
+		devAppServer, apiHost string
+		want                  bool
+	}{
+		{"", "", false},
+		{"1", "", true},
+		// A local API host, such as that of a proxy, doesn't make a dev server.
+		{"", "localhost", false},
+		{"", "127.0.0.1", false},
+		{"", "appengine.googleapis.internal", false},
+	}
+	for _, tc := range testCases {
+		os.Setenv("RUN_WITH_DEVAPPSERVER", tc.devAppServer)
+		os.Setenv("API_HOST", tc.apiHost)
+		reset()
+		if got := IsDevAppServer(); got != tc.want {
+			t.Errorf("RUN_WITH_DEVAPPSERVER=%q API_HOST=%q: IsDevAppServer() = %t, want %t", tc.devAppServer, tc.apiHost, got, tc.want)
+		}
+	}
+
+	// The result is cached.
+	os.Setenv("RUN_WITH_DEVAPPSERVER", "1")
+	if IsDevAppServer() {
+		t.Error("IsDevAppServer() changed without a reset; want the cached result")
+	}
+}
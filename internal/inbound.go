@@ -0,0 +1,391 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file has code for interpreting the App Engine specific headers
+// attached to inbound requests.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var experimentHeader = struct {
+	sync.RWMutex
+	name string
+}{name: http.CanonicalHeaderKey("X-AppEngine-Experiment")}
+
+// SetExperimentHeader changes the inbound header that experiment assignments
+// are read from. The default is X-AppEngine-Experiment.
+func SetExperimentHeader(name string) {
+	experimentHeader.Lock()
+	experimentHeader.name = http.CanonicalHeaderKey(name)
+	experimentHeader.Unlock()
+}
+
+func experimentHeaderName() string {
+	experimentHeader.RLock()
+	defer experimentHeader.RUnlock()
+	return experimentHeader.name
+}
+
+// parseExperiments parses comma-separated experiment assignments
+// such as "checkout=v2, banner=off".
+// An assignment without a value maps to the empty string.
+func parseExperiments(vals []string) map[string]string {
+	m := make(map[string]string)
+	for _, v := range vals {
+		for _, kv := range strings.Split(v, ",") {
+			kv = strings.TrimSpace(kv)
+			if kv == "" {
+				continue
+			}
+			k, val := kv, ""
+			if i := strings.Index(kv, "="); i >= 0 {
+				k, val = strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+			}
+			if k != "" {
+				m[k] = val
+			}
+		}
+	}
+	return m
+}
+
+var inboundVerifier = struct {
+	sync.RWMutex
+	f func(*http.Request) error
+}{}
+
+// SetInboundVerifier installs a function that checks every inbound request
+// before its handler runs, such as by verifying a signature header. Requests
+// for which f returns an error are answered with HTTP 403 and logged.
+// f may read the request body, which is decompressed already if it was sent
+// gzipped; what f reads is kept, so the handler still gets the whole body.
+// A nil f disables verification, which is the default.
+func SetInboundVerifier(f func(r *http.Request) error) {
+	inboundVerifier.Lock()
+	inboundVerifier.f = f
+	inboundVerifier.Unlock()
+}
+
+func verifyInbound(r *http.Request) error {
+	inboundVerifier.RLock()
+	f := inboundVerifier.f
+	inboundVerifier.RUnlock()
+	if f == nil {
+		return nil
+	}
+	if r.Body == nil {
+		return f(r)
+	}
+	// Keep what f reads of the body, and put it back for the handler.
+	body := r.Body
+	var read bytes.Buffer
+	r.Body = ioutil.NopCloser(io.TeeReader(body, &read))
+	err := f(r)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(&read, body), body}
+	return err
+}
+
+// authContextHeader carries the sanitized authentication context
+// of the inbound request on API calls, if forwarding is enabled.
+var authContextHeader = http.CanonicalHeaderKey("X-AppEngine-Auth-Context")
+
+var forwardAuthContext int32 // atomic; 1 if enabled
+
+// SetForwardAuthContext controls whether API calls carry the authentication
+// context of the inbound request. Only the user ID, auth domain and admin
+// status are forwarded; credentials and email addresses never are.
+// It is disabled by default.
+func SetForwardAuthContext(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&forwardAuthContext, v)
+}
+
+// parseAuthContext returns the sanitized authentication context of an inbound
+// request, or the empty string if the request has no signed-in user.
+func parseAuthContext(h http.Header) string {
+	id := h.Get("X-AppEngine-User-Id")
+	if id == "" {
+		return ""
+	}
+	v := url.Values{"user_id": {id}}
+	if d := h.Get("X-AppEngine-Auth-Domain"); d != "" {
+		v.Set("auth_domain", d)
+	}
+	if h.Get("X-AppEngine-User-Is-Admin") == "1" {
+		v.Set("admin", "1")
+	}
+	return v.Encode()
+}
+
+// cronHeader is set to "true" on requests made by the cron service.
+// App Engine removes it from requests made by anyone else.
+var cronHeader = http.CanonicalHeaderKey("X-Appengine-Cron")
+
+// IsCron reports whether the inbound request was made by the cron service.
+func (c *context) IsCron() bool {
+	return c.cron
+}
+
+// RequireCron returns a handler that serves requests made by the cron service
+// with next, and answers all other requests with HTTP 403.
+func RequireCron(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c := fromContext(r.Context()); c == nil || !c.IsCron() {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TaskInfo describes the push task that an inbound request is running.
+// Its fields are empty if the request isn't for a task.
+type TaskInfo struct {
+	QueueName      string
+	TaskName       string
+	RetryCount     int // number of times the task has been retried
+	ExecutionCount int // number of times the task has previously failed
+	ETA            time.Time
+}
+
+// parseTaskInfo parses the task headers of an inbound request.
+// Values of the wrong format are ignored.
+func parseTaskInfo(h http.Header) TaskInfo {
+	ti := TaskInfo{
+		QueueName: h.Get("X-AppEngine-QueueName"),
+		TaskName:  h.Get("X-AppEngine-TaskName"),
+	}
+	ti.RetryCount, _ = strconv.Atoi(h.Get("X-AppEngine-TaskRetryCount"))
+	ti.ExecutionCount, _ = strconv.Atoi(h.Get("X-AppEngine-TaskExecutionCount"))
+	if secs, _ := strconv.ParseFloat(h.Get("X-AppEngine-TaskETA"), 64); secs != 0 {
+		ti.ETA = time.Unix(0, int64(secs*1e9))
+	}
+	return ti
+}
+
+// TaskInfo returns information about the push task
+// that the inbound request is running, if any.
+func (c *context) TaskInfo() TaskInfo {
+	return c.taskInfo
+}
+
+// Experiments returns the experiment assignments carried by the inbound request.
+// The returned map must not be modified.
+func (c *context) Experiments() map[string]string {
+	return c.experiments
+}
+
+// apiVersionHeader carries the version of the App Engine API advertised
+// by the runtime that served the inbound request.
+var apiVersionHeader = http.CanonicalHeaderKey("X-AppEngine-API-Version")
+
+// APIVersion returns the API version advertised with the inbound request,
+// or the empty string if none was.
+func (c *context) APIVersion() string {
+	return c.apiVersion
+}
+
+// timeoutHeader carries the time budget of the inbound request, in milliseconds.
+var timeoutHeader = http.CanonicalHeaderKey("X-AppEngine-Timeout-Ms")
+
+// parseTimeout returns the time budget given in the headers of an inbound
+// request, or zero if there is none. Values of the wrong format are ignored.
+func parseTimeout(h http.Header) time.Duration {
+	ms, err := strconv.Atoi(h.Get(timeoutHeader))
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// parseTraceSampled reports whether the trace context of an inbound request,
+// which is of the form TRACE_ID/SPAN_ID;o=OPTIONS, has the sampled bit set
+// in its options.
+func parseTraceSampled(h http.Header) bool {
+	info := h.Get(traceHeader)
+	i := strings.Index(info, ";o=")
+	if i < 0 {
+		return false
+	}
+	o, err := strconv.ParseUint(info[i+len(";o="):], 10, 32)
+	return err == nil && o&1 != 0
+}
+
+// TraceSampled reports whether the inbound request was sampled for tracing.
+// The trace context is forwarded on API calls, so they are sampled likewise.
+func (c *context) TraceSampled() bool {
+	return c.traceSampled
+}
+
+var peerIdentityHeader = struct {
+	sync.RWMutex
+	name string
+}{name: http.CanonicalHeaderKey("X-AppEngine-Peer-Identity")}
+
+// SetPeerIdentityHeader changes the inbound header that the verified identity
+// of the calling service is read from. The default is X-AppEngine-Peer-Identity.
+// The header must be one that the front end removes from requests from anyone
+// else, or the identity can't be trusted.
+func SetPeerIdentityHeader(name string) {
+	peerIdentityHeader.Lock()
+	peerIdentityHeader.name = http.CanonicalHeaderKey(name)
+	peerIdentityHeader.Unlock()
+}
+
+// parsePeerIdentity returns the verified identity of the service that made
+// an inbound request, or the empty string if there is none.
+func parsePeerIdentity(h http.Header) string {
+	peerIdentityHeader.RLock()
+	name := peerIdentityHeader.name
+	peerIdentityHeader.RUnlock()
+	return strings.TrimSpace(h.Get(name))
+}
+
+// PeerIdentity returns the verified identity of the service that made the
+// inbound request, as given in the header set with SetPeerIdentityHeader.
+// It reports false if the request carried none.
+func (c *context) PeerIdentity() (string, bool) {
+	return c.peerIdentity, c.peerIdentity != ""
+}
+
+// decodeRequestBody replaces the body of the inbound request r, if it has
+// Content-Encoding gzip, with the decompressed body, so that handlers needn't
+// decompress it. The decompressed body may be at most maxDecompressedSize
+// bytes; reading more fails.
+func decodeRequestBody(r *http.Request) error {
+	if !strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip") {
+		return nil
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err == io.EOF {
+		// An empty body.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("gzip: %v", err)
+	}
+	r.Body = &limitedBody{r: zr, c: r.Body, limit: maxDecompressedSize}
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = -1
+	return nil
+}
+
+// limitedBody is a decompressed request body, which fails to read once
+// more than limit bytes have been read.
+type limitedBody struct {
+	r     io.Reader
+	c     io.Closer // the compressed body
+	n     int64     // bytes read so far, which may exceed limit
+	limit int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.n > b.limit {
+		return 0, b.tooLarge()
+	}
+	before := b.n
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.n > b.limit {
+		// Return only the bytes within the limit.
+		return int(b.limit - before), b.tooLarge()
+	}
+	return n, err
+}
+
+func (b *limitedBody) tooLarge() error {
+	return fmt.Errorf("decompressed request body exceeds %d bytes", b.limit)
+}
+
+func (b *limitedBody) Close() error {
+	return b.c.Close()
+}
+
+// isHTTPS reports whether the inbound request r reached the front end over HTTPS.
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil ||
+		r.Header.Get("X-AppEngine-Https") == "on" ||
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// RequestBaseURL returns the scheme and host that the inbound request was
+// made to, such as "https://my-app.appspot.com", for building absolute URLs.
+// The host is the default version hostname if known, and otherwise the host
+// the request was addressed to. It returns the empty string if neither is known.
+func (c *context) RequestBaseURL() string {
+	host := c.defaultVersionHostname
+	if host == "" {
+		host = c.req.Host
+	}
+	if host == "" {
+		return ""
+	}
+	if isHTTPS(c.req) {
+		return "https://" + host
+	}
+	return "http://" + host
+}
+
+// UserAgent returns the User-Agent of the inbound request.
+func (c *context) UserAgent() string {
+	return c.req.UserAgent()
+}
+
+var botPatterns = struct {
+	sync.RWMutex
+	p []string // lower case
+}{p: []string{"bot", "crawler", "spider", "slurp", "facebookexternalhit", "mediapartners-google"}}
+
+// SetBotPatterns replaces the substrings of User-Agent strings that
+// IsLikelyBot takes to mean the request came from a crawler.
+// Patterns are matched without regard to case.
+func SetBotPatterns(patterns []string) {
+	p := make([]string, len(patterns))
+	for i, s := range patterns {
+		p[i] = strings.ToLower(s)
+	}
+	botPatterns.Lock()
+	botPatterns.p = p
+	botPatterns.Unlock()
+}
+
+// IsLikelyBot reports whether the User-Agent of the inbound request
+// contains one of the patterns set with SetBotPatterns.
+func (c *context) IsLikelyBot() bool {
+	ua := strings.ToLower(c.UserAgent())
+	if ua == "" {
+		return false
+	}
+	botPatterns.RLock()
+	defer botPatterns.RUnlock()
+	for _, p := range botPatterns.p {
+		if strings.Contains(ua, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,529 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	basepb "google.golang.org/appengine/internal/base"
+)
+
+func TestExperiments(t *testing.T) {
+	SetExperimentHeader("X-Test-Experiments")
+	defer SetExperimentHeader("X-AppEngine-Experiment")
+
+	var got map[string]string
+	http.HandleFunc("/experiments", func(w http.ResponseWriter, r *http.Request) {
+		got = fromContext(r.Context()).Experiments()
+	})
+
+	RunHandler("/experiments", http.Header{
+		"X-Test-Experiments": []string{"checkout=v2, banner = off", "beta"},
+	}, nil)
+
+	want := map[string]string{
+		"checkout": "v2",
+		"banner":   "off",
+		"beta":     "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Experiments() = %v, want %v", got, want)
+	}
+}
+
+func TestInboundVerifier(t *testing.T) {
+	SetInboundVerifier(func(r *http.Request) error {
+		if r.Header.Get("X-Test-Signature") != "valid" {
+			return errors.New("missing signature")
+		}
+		return nil
+	})
+	defer SetInboundVerifier(nil)
+
+	var handled bool
+	http.HandleFunc("/signed", func(w http.ResponseWriter, r *http.Request) {
+		handled = true
+	})
+
+	testCases := []struct {
+		headers http.Header
+		code    int
+		handled bool
+	}{
+		{http.Header{}, http.StatusForbidden, false},
+		{http.Header{"X-Test-Signature": []string{"forged"}}, http.StatusForbidden, false},
+		{http.Header{"X-Test-Signature": []string{"valid"}}, http.StatusOK, true},
+	}
+	for _, tc := range testCases {
+		handled = false
+		rec := RunHandler("/signed", tc.headers, nil)
+		if rec.Code != tc.code {
+			t.Errorf("Header %v: got HTTP %d, want %d", tc.headers, rec.Code, tc.code)
+		}
+		if handled != tc.handled {
+			t.Errorf("Header %v: handler ran = %t, want %t", tc.headers, handled, tc.handled)
+		}
+	}
+}
+
+func TestInboundVerifierReadsBody(t *testing.T) {
+	const body = "signed payload"
+	SetInboundVerifier(func(r *http.Request) error {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		if string(b) != body {
+			return fmt.Errorf("body is %q, want %q", b, body)
+		}
+		return nil
+	})
+	defer SetInboundVerifier(nil)
+
+	var got string
+	http.HandleFunc("/signed_body", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = string(b)
+	})
+	rec := RunHandler("/signed_body", http.Header{}, []byte(body))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Got HTTP %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got != body {
+		t.Errorf("Handler read body %q after verification, want %q", got, body)
+	}
+}
+
+func TestForwardAuthContext(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	http.HandleFunc("/auth_call", func(w http.ResponseWriter, r *http.Request) {
+		fromContext(r.Context()).apiURL = c.apiURL
+		if err := Call(r.Context(), "attachments", "Echo", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+			t.Errorf("API call failed: %v", err)
+		}
+	})
+	headers := http.Header{
+		ticketHeader:                []string{"s3cr3t"},
+		dapperHeader:                []string{"trace-001"},
+		"X-Appengine-User-Id":       []string{"42"},
+		"X-Appengine-User-Email":    []string{"someone@example.com"},
+		"X-Appengine-Auth-Domain":   []string{"example.com"},
+		"X-Appengine-User-Is-Admin": []string{"1"},
+		"Authorization":             []string{"Bearer secret-token"},
+	}
+
+	RunHandler("/auth_call", headers, nil)
+	if got := f.lastHeader("attachments", "Echo", authContextHeader); got != "" {
+		t.Errorf("With forwarding disabled: %s = %q, want empty", authContextHeader, got)
+	}
+
+	SetForwardAuthContext(true)
+	defer SetForwardAuthContext(false)
+	RunHandler("/auth_call", headers, nil)
+	if got, want := f.lastHeader("attachments", "Echo", authContextHeader), "admin=1&auth_domain=example.com&user_id=42"; got != want {
+		t.Errorf("With forwarding enabled: %s = %q, want %q", authContextHeader, got, want)
+	}
+	if got := f.lastHeader("attachments", "Echo", "Authorization"); got != "" {
+		t.Errorf("Authorization header was forwarded: %q", got)
+	}
+}
+
+func TestCron(t *testing.T) {
+	var isCron bool
+	http.Handle("/cron", RequireCron(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isCron = fromContext(r.Context()).IsCron()
+	})))
+
+	if rec := RunHandler("/cron", http.Header{"X-Appengine-Cron": []string{"true"}}, nil); rec.Code != http.StatusOK {
+		t.Errorf("Cron request: got HTTP %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !isCron {
+		t.Error("Cron request: IsCron() = false, want true")
+	}
+
+	isCron = false
+	if rec := RunHandler("/cron", nil, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("Non-cron request: got HTTP %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if isCron {
+		t.Error("Non-cron request reached the handler")
+	}
+}
+
+func TestTaskInfo(t *testing.T) {
+	var got TaskInfo
+	http.HandleFunc("/task", func(w http.ResponseWriter, r *http.Request) {
+		got = fromContext(r.Context()).TaskInfo()
+	})
+
+	RunHandler("/task", http.Header{
+		"X-Appengine-Queuename":          []string{"mail"},
+		"X-Appengine-Taskname":           []string{"send-welcome"},
+		"X-Appengine-Taskretrycount":     []string{"3"},
+		"X-Appengine-Taskexecutioncount": []string{"2"},
+		"X-Appengine-Tasketa":            []string{"1500000000.5"},
+	}, nil)
+	want := TaskInfo{
+		QueueName:      "mail",
+		TaskName:       "send-welcome",
+		RetryCount:     3,
+		ExecutionCount: 2,
+		ETA:            time.Unix(1500000000, 5e8),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TaskInfo() = %+v, want %+v", got, want)
+	}
+
+	RunHandler("/task", nil, nil)
+	if !reflect.DeepEqual(got, TaskInfo{}) {
+		t.Errorf("Without task headers: TaskInfo() = %+v, want empty", got)
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	var got string
+	http.HandleFunc("/api_version", func(w http.ResponseWriter, r *http.Request) {
+		got = fromContext(r.Context()).APIVersion()
+	})
+
+	RunHandler("/api_version", http.Header{"X-Appengine-Api-Version": []string{"go1"}}, nil)
+	if want := "go1"; got != want {
+		t.Errorf("APIVersion() = %q, want %q", got, want)
+	}
+
+	RunHandler("/api_version", nil, nil)
+	if got != "" {
+		t.Errorf("Without the header, APIVersion() = %q, want empty", got)
+	}
+}
+
+func TestTraceSampled(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	var sampled, childSampled bool
+	http.HandleFunc("/trace_sampled", func(w http.ResponseWriter, r *http.Request) {
+		rc := fromContext(r.Context())
+		rc.apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		sampled = rc.TraceSampled()
+		childSampled = rc.ChildContext(time.Second).TraceSampled()
+		Call(r.Context(), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	})
+
+	for _, tc := range []struct {
+		trace string
+		want  bool
+	}{
+		{"105445aa7843bc8bf206b12000100000/1;o=1", true},
+		{"105445aa7843bc8bf206b12000100000/1;o=3", true},
+		{"105445aa7843bc8bf206b12000100000/1;o=0", false},
+		{"105445aa7843bc8bf206b12000100000/1", false},
+		{"105445aa7843bc8bf206b12000100000/1;o=yes", false},
+	} {
+		h := http.Header{"X-Cloud-Trace-Context": []string{tc.trace}}
+		for k, v := range c.req.Header {
+			h[k] = v
+		}
+		RunHandler("/trace_sampled", h, nil)
+		if sampled != tc.want || childSampled != tc.want {
+			t.Errorf("Trace %q: TraceSampled() = %t, for a child %t, want %t", tc.trace, sampled, childSampled, tc.want)
+		}
+		if got := f.lastHeader("actordb", "LookupActor", traceHeader); got != tc.trace {
+			t.Errorf("Trace %q: forwarded trace context %q, want it unchanged", tc.trace, got)
+		}
+	}
+}
+
+func TestPeerIdentity(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	var identity, childIdentity string
+	var ok, childOK bool
+	http.HandleFunc("/peer_identity", func(w http.ResponseWriter, r *http.Request) {
+		rc := fromContext(r.Context())
+		rc.apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		identity, ok = rc.PeerIdentity()
+		childIdentity, childOK = rc.ChildContext(time.Second).PeerIdentity()
+	})
+	run := func(h http.Header) {
+		for k, v := range c.req.Header {
+			h[k] = v
+		}
+		RunHandler("/peer_identity", h, nil)
+	}
+
+	run(http.Header{"X-Appengine-Peer-Identity": {"billing@my-app.iam"}})
+	if identity != "billing@my-app.iam" || !ok {
+		t.Errorf("PeerIdentity() = %q, %t, want %q, true", identity, ok, "billing@my-app.iam")
+	}
+	if childIdentity != identity || childOK != ok {
+		t.Errorf("For a child, PeerIdentity() = %q, %t, want %q, %t", childIdentity, childOK, identity, ok)
+	}
+
+	run(http.Header{})
+	if identity != "" || ok {
+		t.Errorf("Without the header, PeerIdentity() = %q, %t, want none", identity, ok)
+	}
+
+	SetPeerIdentityHeader("X-Verified-Peer")
+	defer SetPeerIdentityHeader("X-AppEngine-Peer-Identity")
+	run(http.Header{"X-Verified-Peer": {"search@my-app.iam"}})
+	if identity != "search@my-app.iam" || !ok {
+		t.Errorf("With a configured header, PeerIdentity() = %q, %t, want %q, true", identity, ok, "search@my-app.iam")
+	}
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	var body string
+	var readErr error
+	http.HandleFunc("/gzip_body", func(w http.ResponseWriter, r *http.Request) {
+		fromContext(r.Context()).apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		b, err := ioutil.ReadAll(r.Body)
+		body, readErr = string(b), err
+	})
+	post := func(b []byte, gzipped bool) int {
+		h := http.Header{}
+		for k, v := range c.req.Header {
+			h[k] = v
+		}
+		if gzipped {
+			h.Set("Content-Encoding", "gzip")
+		}
+		body, readErr = "", nil
+		return RunHandler("/gzip_body", h, b).Code
+	}
+	gz := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	const want = "The quick brown fox jumps over the lazy dog."
+	post(gz(want), true)
+	if body != want || readErr != nil {
+		t.Errorf("Gzipped body read as %q, %v, want %q", body, readErr, want)
+	}
+	post([]byte(want), false)
+	if body != want || readErr != nil {
+		t.Errorf("Plain body read as %q, %v, want %q", body, readErr, want)
+	}
+	if code := post([]byte("not gzip at all"), true); code != http.StatusBadRequest {
+		t.Errorf("Bad gzipped body answered with HTTP %d, want %d", code, http.StatusBadRequest)
+	}
+
+	defer func(n int64) { maxDecompressedSize = n }(maxDecompressedSize)
+	maxDecompressedSize = 10
+	post(gz(want), true)
+	if readErr == nil {
+		t.Errorf("Gzipped body over the size limit read as %q, want an error", body)
+	}
+	if len(body) > 10 {
+		t.Errorf("Read %d bytes of a gzipped body over the size limit, want at most 10", len(body))
+	}
+}
+
+func TestLimitedBody(t *testing.T) {
+	b := &limitedBody{r: strings.NewReader("The quick brown fox"), c: ioutil.NopCloser(nil), limit: 10}
+	var got []byte
+	p := make([]byte, 4)
+	for i := 0; i < 5; i++ {
+		n, err := b.Read(p)
+		if n < 0 || n > len(p) {
+			t.Fatalf("Read %d returned %d bytes, want 0 to %d", i, n, len(p))
+		}
+		got = append(got, p[:n]...)
+		if i >= 2 && (err == nil || (i > 2 && n != 0)) {
+			t.Errorf("Read %d past the limit = %d, %v, want 0 and an error", i, n, err)
+		}
+	}
+	if want := "The quick "; string(got) != want {
+		t.Errorf("Read %q, want %q", got, want)
+	}
+
+	// A bufio.Reader, which panics on a negative count, reads it cleanly.
+	b = &limitedBody{r: strings.NewReader("The quick brown fox"), c: ioutil.NopCloser(nil), limit: 10}
+	if _, err := ioutil.ReadAll(bufio.NewReaderSize(b, 16)); err == nil {
+		t.Error("Reading past the limit through bufio succeeded, want an error")
+	}
+}
+
+func TestPrepareOutbound(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	c.req.Header.Set(traceHeader, "105445aa7843bc8bf206b12000100000/1;o=1")
+	c.req.Header.Set("X-AppEngine-Request-Log-Id", "5c8a1b2c00ff0bd6")
+	c.deadline = time.Now().Add(2 * time.Second)
+
+	req := httptest.NewRequest("GET", "http://downstream.example.com/", nil)
+	req.Header.Set("X-Custom", "kept")
+	c.PrepareOutbound(req)
+	for key, want := range map[string]string{
+		"X-Cloud-Trace-Context":      "105445aa7843bc8bf206b12000100000/1;o=1",
+		"X-Google-Dappertraceinfo":   "trace-001",
+		"X-Appengine-Request-Log-Id": "5c8a1b2c00ff0bd6",
+		"X-Custom":                   "kept",
+	} {
+		if got := req.Header.Get(key); got != want {
+			t.Errorf("Header %s = %q, want %q", key, got, want)
+		}
+	}
+	ms, err := strconv.Atoi(req.Header.Get("X-Appengine-Timeout-Ms"))
+	if err != nil || ms <= 1000 || ms > 2000 {
+		t.Errorf("Timeout header = %q, want about 2000ms", req.Header.Get("X-Appengine-Timeout-Ms"))
+	}
+
+	// Without a deadline, no budget is forwarded.
+	c.deadline = time.Time{}
+	req = httptest.NewRequest("GET", "http://downstream.example.com/", nil)
+	c.PrepareOutbound(req)
+	if got := req.Header.Get("X-Appengine-Timeout-Ms"); got != "" {
+		t.Errorf("Without a deadline: timeout header = %q, want none", got)
+	}
+}
+
+func TestInboundTimeout(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	var deadline time.Time
+	http.HandleFunc("/budget", func(w http.ResponseWriter, r *http.Request) {
+		rc := fromContext(r.Context())
+		rc.apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		deadline = rc.deadline
+		Call(r.Context(), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	})
+
+	h := http.Header{"X-Appengine-Timeout-Ms": []string{"2000"}}
+	for k, v := range c.req.Header {
+		h[k] = v
+	}
+	start := time.Now()
+	RunHandler("/budget", h, nil)
+	if deadline.Before(start) || deadline.After(start.Add(2*time.Second+100*time.Millisecond)) {
+		t.Errorf("Context deadline is %v after the request started, want about 2s", deadline.Sub(start))
+	}
+	secs, err := strconv.ParseFloat(f.lastDeadlineHeader("actordb", "LookupActor"), 64)
+	if err != nil {
+		t.Fatalf("Bad deadline header: %v", err)
+	}
+	if secs <= 1.5 || secs > 2 {
+		t.Errorf("Call deadline is %vs, want it derived from the 2s budget", secs)
+	}
+
+	RunHandler("/budget", c.req.Header, nil)
+	if !deadline.IsZero() {
+		t.Errorf("Without the header, the context deadline is %v, want none", deadline)
+	}
+}
+
+func TestInboundTimeoutOverrun(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	http.HandleFunc("/overrun", func(w http.ResponseWriter, r *http.Request) {
+		fromContext(r.Context()).apiURL = c.apiURL // Otherwise it will try to use the default URL.
+		Logf(r.Context(), 1, "over budget")
+		time.Sleep(30 * time.Millisecond)
+	})
+
+	h := http.Header{"X-Appengine-Timeout-Ms": []string{"20"}}
+	for k, v := range c.req.Header {
+		h[k] = v
+	}
+	RunHandler("/overrun", h, nil)
+	if n := atomic.LoadInt32(&f.LogFlushes); n != 1 {
+		t.Fatalf("LogFlushes = %d, want 1", n)
+	}
+	if got := f.flushedLogs(); len(got) != 1 || len(got[0]) != 1 || got[0][0] != "over budget" {
+		t.Errorf("Flushed logs are %q, want the handler's", got)
+	}
+}
+
+func TestRequestBaseURL(t *testing.T) {
+	var got string
+	http.HandleFunc("/base_url", func(w http.ResponseWriter, r *http.Request) {
+		got = fromContext(r.Context()).RequestBaseURL()
+	})
+
+	RunHandler("/base_url", http.Header{
+		"X-Appengine-Default-Version-Hostname": []string{"my-app.appspot.com"},
+		"X-Appengine-Https":                    []string{"on"},
+	}, nil)
+	if want := "https://my-app.appspot.com"; got != want {
+		t.Errorf("HTTPS request: RequestBaseURL() = %q, want %q", got, want)
+	}
+
+	RunHandler("/base_url", http.Header{
+		"X-Appengine-Default-Version-Hostname": []string{"my-app.appspot.com"},
+	}, nil)
+	if want := "http://my-app.appspot.com"; got != want {
+		t.Errorf("HTTP request: RequestBaseURL() = %q, want %q", got, want)
+	}
+
+	c := &context{req: &http.Request{Host: "example.com", Header: http.Header{"X-Forwarded-Proto": []string{"https"}}}}
+	if got, want := c.RequestBaseURL(), "https://example.com"; got != want {
+		t.Errorf("Without a default version hostname: RequestBaseURL() = %q, want %q", got, want)
+	}
+	c = &context{req: &http.Request{Header: http.Header{}}}
+	if got := c.RequestBaseURL(); got != "" {
+		t.Errorf("Without a host: RequestBaseURL() = %q, want empty", got)
+	}
+}
+
+func TestIsLikelyBot(t *testing.T) {
+	newContext := func(ua string) *context {
+		return &context{req: &http.Request{Header: http.Header{"User-Agent": []string{ua}}}}
+	}
+	const crawler = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	const browser = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/74.0 Safari/537.36"
+
+	if got := newContext(crawler).UserAgent(); got != crawler {
+		t.Errorf("UserAgent() = %q, want %q", got, crawler)
+	}
+	if !newContext(crawler).IsLikelyBot() {
+		t.Errorf("IsLikelyBot() = false for %q, want true", crawler)
+	}
+	if newContext(browser).IsLikelyBot() {
+		t.Errorf("IsLikelyBot() = true for %q, want false", browser)
+	}
+	if newContext("").IsLikelyBot() {
+		t.Error("IsLikelyBot() = true without a User-Agent, want false")
+	}
+
+	SetBotPatterns([]string{"Chrome"})
+	defer SetBotPatterns([]string{"bot", "crawler", "spider", "slurp", "facebookexternalhit", "mediapartners-google"})
+	if !newContext(browser).IsLikelyBot() {
+		t.Error("With custom patterns: IsLikelyBot() = false for a matching User-Agent, want true")
+	}
+	if newContext(crawler).IsLikelyBot() {
+		t.Error("With custom patterns: IsLikelyBot() = true for a User-Agent matching only the defaults, want false")
+	}
+}
@@ -43,7 +43,8 @@ func RegisterTimeoutErrorCode(service string, code int32) {
 type APIError struct {
 	Service string
 	Detail  string
-	Code    int32 // API-specific error code
+	Code    int32  // API-specific error code
+	CallID  string // identifies the failed call, if known
 }
 
 func (e *APIError) Error() string {
@@ -77,6 +78,7 @@ type CallError struct {
 	Code   int32
 	// TODO: Remove this if we get a distinguishable error code.
 	Timeout bool
+	CallID  string // identifies the failed call, if known
 }
 
 func (e *CallError) Error() string {
@@ -104,6 +106,24 @@ func (e *CallError) IsTimeout() bool {
 	return e.Timeout
 }
 
+// RootCallError returns the *CallError underlying err, following the chain
+// of errors that wrap it, such as those returned by call overrides that add
+// context to the errors of the calls they make. A wrapping error exposes the
+// error it wraps with an Unwrap method. It returns nil if there is none.
+func RootCallError(err error) *CallError {
+	for err != nil {
+		if ce, ok := err.(*CallError); ok {
+			return ce
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = u.Unwrap()
+	}
+	return nil
+}
+
 // NamespaceMods is a map from API service to a function that will mutate an RPC request to attach a namespace.
 // The function should be prepared to be called on the same message more than once; it should only modify the
 // RPC request the first time.
@@ -0,0 +1,46 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements calls whose messages are given and returned as JSON.
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// CallJSON makes an API call like Call, but with its request and response
+// messages in their proto3 JSON form. The request is decoded into, and the
+// response decoded as, a message of the same type as outTmpl, which suits
+// services whose requests and responses share a type; outTmpl itself is
+// not modified. opts may be nil.
+func (c *context) CallJSON(service, method string, jsonIn []byte, outTmpl proto.Message, opts *CallOptions) ([]byte, error) {
+	in := proto.Clone(outTmpl)
+	in.Reset()
+	if err := jsonpb.Unmarshal(bytes.NewReader(jsonIn), in); err != nil {
+		return nil, fmt.Errorf("decoding JSON request: %v", err)
+	}
+	out := proto.Clone(outTmpl)
+	out.Reset()
+
+	ctx := toContext(c)
+	if opts != nil {
+		ctx = WithCallOptions(ctx, opts)
+	}
+	if err := Call(ctx, service, method, in, out); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, out); err != nil {
+		return nil, fmt.Errorf("encoding JSON response: %v", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements request-scoped memoization of derived values.
+
+import "sync"
+
+// memoEntry holds a value computed by Once.
+type memoEntry struct {
+	once sync.Once
+	v    interface{}
+	err  error
+}
+
+// Once returns the result of fn, calling it only the first time Once is
+// called with key for c's request; later calls return the same value and
+// error. Concurrent calls with the same key wait for the first to finish.
+// The results are shared with contexts derived from c by ChildContext.
+func (c *context) Once(key string, fn func() (interface{}, error)) (interface{}, error) {
+	if c.parent != nil {
+		c = c.parent
+	}
+	c.memo.Lock()
+	e := c.memo.m[key]
+	if e == nil {
+		if c.memo.m == nil {
+			c.memo.m = make(map[string]*memoEntry)
+		}
+		e = &memoEntry{}
+		c.memo.m[key] = e
+	}
+	c.memo.Unlock()
+
+	e.once.Do(func() {
+		e.v, e.err = fn()
+	})
+	return e.v, e.err
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file renders CallStats in the Prometheus text exposition format.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WriteMetrics writes the counters returned by CallStats to w in the
+// Prometheus text exposition format, such as for a /metrics handler.
+// Each group of calls is labeled with its service, method and tags.
+func WriteMetrics(w io.Writer) error {
+	stats := CallStats()
+	keys := make([]StatKey, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Tags < b.Tags
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# HELP appengine_api_calls_total API calls made.")
+	fmt.Fprintln(bw, "# TYPE appengine_api_calls_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(bw, "appengine_api_calls_total{%s} %d\n", metricLabels(k), stats[k].Calls)
+	}
+
+	fmt.Fprintln(bw, "# HELP appengine_api_errors_total API calls that failed, by RPC error code.")
+	fmt.Fprintln(bw, "# TYPE appengine_api_errors_total counter")
+	for _, k := range keys {
+		s := stats[k]
+		codes := make([]int, 0, len(s.ErrorCodes))
+		other := s.Errors
+		for code, n := range s.ErrorCodes {
+			codes = append(codes, int(code))
+			other -= n
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			fmt.Fprintf(bw, "appengine_api_errors_total{%s,code=\"%d\"} %d\n", metricLabels(k), code, s.ErrorCodes[int32(code)])
+		}
+		if other > 0 {
+			// These failed some other way, such as with an *APIError.
+			fmt.Fprintf(bw, "appengine_api_errors_total{%s,code=\"other\"} %d\n", metricLabels(k), other)
+		}
+	}
+
+	fmt.Fprintln(bw, "# HELP appengine_api_call_duration_seconds How long API calls took.")
+	fmt.Fprintln(bw, "# TYPE appengine_api_call_duration_seconds histogram")
+	for _, k := range keys {
+		s, labels := stats[k], metricLabels(k)
+		var n int64
+		for i, bound := range LatencyBounds {
+			n += s.Latency[i]
+			fmt.Fprintf(bw, "appengine_api_call_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(bound.Seconds(), 'f', -1, 64), n)
+		}
+		fmt.Fprintf(bw, "appengine_api_call_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, s.Calls)
+		fmt.Fprintf(bw, "appengine_api_call_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(s.Time.Seconds(), 'f', -1, 64))
+		fmt.Fprintf(bw, "appengine_api_call_duration_seconds_count{%s} %d\n", labels, s.Calls)
+	}
+	return bw.Flush()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricLabels returns the labels identifying a group of calls in metrics.
+func metricLabels(k StatKey) string {
+	return fmt.Sprintf(`service="%s",method="%s",tags="%s"`,
+		labelValueEscaper.Replace(k.Service),
+		labelValueEscaper.Replace(k.Method),
+		labelValueEscaper.Replace(k.Tags))
+}
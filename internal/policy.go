@@ -0,0 +1,53 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements an instance-wide policy of which API methods may be called.
+
+import (
+	"fmt"
+	"sync"
+
+	remotepb "google.golang.org/appengine/internal/remote_api"
+)
+
+type methodKey struct {
+	service, method string
+}
+
+var methodPolicy = struct {
+	sync.RWMutex
+	denied map[methodKey]bool
+}{denied: make(map[methodKey]bool)}
+
+// SetMethodPolicy sets whether calls to service.method are allowed,
+// such as to disable a risky method on the instance. All methods are
+// allowed by default. Calls to a disabled method fail without being made.
+func SetMethodPolicy(service, method string, allowed bool) {
+	methodPolicy.Lock()
+	defer methodPolicy.Unlock()
+	if allowed {
+		delete(methodPolicy.denied, methodKey{service, method})
+	} else {
+		methodPolicy.denied[methodKey{service, method}] = true
+	}
+}
+
+// checkMethodPolicy returns an error if calls to service.method are
+// disabled by SetMethodPolicy.
+func checkMethodPolicy(service, method string) error {
+	methodPolicy.RLock()
+	denied := len(methodPolicy.denied) > 0 && methodPolicy.denied[methodKey{service, method}]
+	methodPolicy.RUnlock()
+	if !denied {
+		return nil
+	}
+	return &CallError{
+		Detail: fmt.Sprintf("method disabled: %s.%s", service, method),
+		Code:   int32(remotepb.RpcError_FEATURE_DISABLED),
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements request-scoped pacing of calls to fragile services.
+
+import (
+	"time"
+
+	netcontext "golang.org/x/net/context"
+)
+
+// rateLimiter is a token bucket that admits calls at a steady rate.
+// Its tokens go negative to account for callers waiting on future tokens.
+type rateLimiter struct {
+	rps    float64
+	tokens float64
+	last   time.Time
+}
+
+// reserve takes a token and returns how long the caller must wait
+// before the token is available. The caller must hold c.limiters.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	l.tokens += now.Sub(l.last).Seconds() * l.rps
+	if l.tokens > 1 {
+		l.tokens = 1 // don't allow bursts
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rps * float64(time.Second))
+}
+
+// RateLimit limits calls made to service with c, or contexts derived from it,
+// to rps calls per second. Calls beyond that rate wait for their turn,
+// failing if it would not come before their deadline.
+// An rps of zero or less removes the limit.
+func (c *context) RateLimit(service string, rps float64) {
+	if c.parent != nil {
+		c.parent.RateLimit(service, rps)
+		return
+	}
+	c.limiters.Lock()
+	defer c.limiters.Unlock()
+	if rps <= 0 {
+		delete(c.limiters.m, service)
+		return
+	}
+	if c.limiters.m == nil {
+		c.limiters.m = make(map[string]*rateLimiter)
+	}
+	c.limiters.m[service] = &rateLimiter{rps: rps, tokens: 1, last: time.Now()}
+}
+
+// waitRateLimit blocks until a call to service is admitted by the limit set
+// with RateLimit, if any. It returns errTimeout if the call would have to wait
+// past the deadline of ctx or c.
+func (c *context) waitRateLimit(ctx netcontext.Context, service string) error {
+	root := c
+	if c.parent != nil {
+		root = c.parent
+	}
+	root.limiters.Lock()
+	l := root.limiters.m[service]
+	if l == nil {
+		root.limiters.Unlock()
+		return nil
+	}
+	now := time.Now()
+	wait := l.reserve(now)
+	root.limiters.Unlock()
+	if wait == 0 {
+		return nil
+	}
+
+	if deadline := c.waitDeadline(ctx); !deadline.IsZero() && now.Add(wait).After(deadline) {
+		root.unreserve(l)
+		return errTimeout
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		root.unreserve(l)
+		return ctx.Err()
+	}
+}
+
+// waitDeadline returns the time by which a call made with ctx and c must have
+// been dispatched, or the zero time if there is no such limit.
+func (c *context) waitDeadline(ctx netcontext.Context) time.Time {
+	deadline := c.deadline
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
+
+// unreserve returns a token taken by waitRateLimit for a call that wasn't made.
+func (c *context) unreserve(l *rateLimiter) {
+	c.limiters.Lock()
+	l.tokens++
+	c.limiters.Unlock()
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file has support for discovering the API host dynamically.
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultResolverTTL is how long a resolved API host is used before
+	// resolving again, unless changed with SetResolverTTL.
+	defaultResolverTTL = 30 * time.Second
+
+	// maxResolvedDialFailures is how many calls in a row may fail to dial
+	// the resolved API host before it is resolved again.
+	maxResolvedDialFailures = 3
+)
+
+var apiResolver struct {
+	sync.Mutex
+	f            func() (host, port string, err error)
+	u            *url.URL // last resolved API URL
+	expires      time.Time
+	ttl          time.Duration // zero for defaultResolverTTL
+	dialFailures int           // consecutive failures to dial u
+}
+
+// SetAPIResolver installs a function that API calls use to find the API host,
+// instead of the API_HOST and API_PORT environment variables. Its result is
+// reused for a while, so f is not called for every API call.
+// A nil f restores the default.
+func SetAPIResolver(f func() (host, port string, err error)) {
+	apiResolver.Lock()
+	apiResolver.f = f
+	apiResolver.u = nil
+	apiResolver.dialFailures = 0
+	apiResolver.Unlock()
+}
+
+// SetResolverTTL sets how long the API host found by the resolver installed
+// with SetAPIResolver is used before resolving it again. The host is also
+// resolved again if several calls in a row fail to dial it.
+// A d of zero or less restores the default of 30 seconds.
+func SetResolverTTL(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	apiResolver.Lock()
+	apiResolver.ttl = d
+	if apiResolver.u != nil && d > 0 {
+		// Don't keep the current host for longer than the new TTL.
+		if exp := time.Now().Add(d); exp.Before(apiResolver.expires) {
+			apiResolver.expires = exp
+		}
+	}
+	apiResolver.Unlock()
+}
+
+// resolveAPIURL returns the API URL given by the installed resolver.
+// It reports false if no resolver is installed.
+func resolveAPIURL() (*url.URL, bool, error) {
+	apiResolver.Lock()
+	defer apiResolver.Unlock()
+	if apiResolver.f == nil {
+		return nil, false, nil
+	}
+	if apiResolver.u != nil && time.Now().Before(apiResolver.expires) {
+		return apiResolver.u, true, nil
+	}
+	host, port, err := apiResolver.f()
+	if err != nil {
+		return nil, true, err
+	}
+	apiResolver.u = &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, port),
+		Path:   currentAPIPath(),
+	}
+	ttl := apiResolver.ttl
+	if ttl == 0 {
+		ttl = defaultResolverTTL
+	}
+	apiResolver.expires = time.Now().Add(ttl)
+	apiResolver.dialFailures = 0
+	return apiResolver.u, true, nil
+}
+
+// resolvedDialResult records whether a call to the resolved API host failed
+// with err to dial it, forgetting the host after too many failures in a row.
+func resolvedDialResult(err error) {
+	apiResolver.Lock()
+	defer apiResolver.Unlock()
+	if apiResolver.f == nil || apiResolver.u == nil {
+		return
+	}
+	if !isDialFailure(err) {
+		apiResolver.dialFailures = 0
+		return
+	}
+	apiResolver.dialFailures++
+	if apiResolver.dialFailures >= maxResolvedDialFailures {
+		apiResolver.u = nil
+		apiResolver.dialFailures = 0
+	}
+}
+
+// isDialFailure reports whether err, from an HTTP client, is a failure
+// to connect to the server.
+func isDialFailure(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	oe, ok := err.(*net.OpError)
+	return ok && oe.Op == "dial"
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	basepb "google.golang.org/appengine/internal/base"
+)
+
+func TestAPIResolver(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	host, port, err := net.SplitHostPort(c.apiURL.Host)
+	if err != nil {
+		t.Fatalf("SplitHostPort(%q): %v", c.apiURL.Host, err)
+	}
+	resolves := 0
+	SetAPIResolver(func() (string, string, error) {
+		resolves++
+		return host, port, nil
+	})
+	defer SetAPIResolver(nil)
+
+	// Without the resolver, this would fail to dial.
+	c.apiURL = &url.URL{Scheme: "http", Host: "127.0.0.1:1", Path: apiPath}
+	for i := 0; i < 2; i++ {
+		res := &basepb.StringProto{}
+		if err := Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, res); err != nil {
+			t.Fatalf("API call failed: %v", err)
+		}
+		if got, want := res.GetValue(), "David Tennant"; got != want {
+			t.Errorf("Response is %q, want %q", got, want)
+		}
+	}
+	if resolves != 1 {
+		t.Errorf("Resolver called %d times, want 1", resolves)
+	}
+}
+
+func TestResolverTTL(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	host, port, err := net.SplitHostPort(c.apiURL.Host)
+	if err != nil {
+		t.Fatalf("SplitHostPort(%q): %v", c.apiURL.Host, err)
+	}
+	resolves := 0
+	SetAPIResolver(func() (string, string, error) {
+		resolves++
+		return host, port, nil
+	})
+	defer SetAPIResolver(nil)
+	SetResolverTTL(20 * time.Millisecond)
+	defer SetResolverTTL(0)
+
+	call := func() {
+		if err := Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+			t.Fatalf("API call failed: %v", err)
+		}
+	}
+	call()
+	call()
+	if resolves != 1 {
+		t.Errorf("Resolver called %d times within the TTL, want 1", resolves)
+	}
+	time.Sleep(40 * time.Millisecond)
+	call()
+	if resolves != 2 {
+		t.Errorf("Resolver called %d times after the TTL, want 2", resolves)
+	}
+}
+
+func TestResolverDialFailures(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	host, port, err := net.SplitHostPort(c.apiURL.Host)
+	if err != nil {
+		t.Fatalf("SplitHostPort(%q): %v", c.apiURL.Host, err)
+	}
+	resolves := 0
+	SetAPIResolver(func() (string, string, error) {
+		resolves++
+		if resolves == 1 {
+			return "127.0.0.1", "1", nil // nothing listens here
+		}
+		return host, port, nil
+	})
+	defer SetAPIResolver(nil)
+
+	call := func() error {
+		return Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	}
+	for i := 0; i < maxResolvedDialFailures; i++ {
+		if err := call(); err == nil {
+			t.Fatalf("API call %d to a dead host succeeded", i)
+		}
+	}
+	if resolves != 1 {
+		t.Errorf("Resolver called %d times before the failures added up, want 1", resolves)
+	}
+	if err := call(); err != nil {
+		t.Errorf("API call after %d dial failures failed: %v", maxResolvedDialFailures, err)
+	}
+	if resolves != 2 {
+		t.Errorf("Resolver called %d times after the failures, want 2", resolves)
+	}
+}
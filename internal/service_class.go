@@ -0,0 +1,55 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// ServiceClass describes the latency expectations of an API service.
+// It determines the deadline forwarded with calls to that service.
+type ServiceClass int
+
+const (
+	// ServiceClassInteractive is for services on the serving path
+	// of user requests. Calls to them get a tight deadline.
+	ServiceClassInteractive ServiceClass = iota + 1
+	// ServiceClassBatch is for services doing bulk or background work.
+	// Calls to them get a generous deadline.
+	ServiceClassBatch
+)
+
+// serviceClassTimeouts is the default timeout for calls to each service class.
+var serviceClassTimeouts = map[ServiceClass]time.Duration{
+	ServiceClassInteractive: 5 * time.Second,
+	ServiceClassBatch:       10 * time.Minute,
+}
+
+var serviceClasses = struct {
+	sync.RWMutex
+	m map[string]ServiceClass
+}{m: make(map[string]ServiceClass)}
+
+// SetServiceClass registers the class of an API service.
+// Calls to services without a class use the default 60 second timeout.
+func SetServiceClass(service string, class ServiceClass) {
+	serviceClasses.Lock()
+	serviceClasses.m[service] = class
+	serviceClasses.Unlock()
+}
+
+// serviceClassTimeout returns the timeout for calls to service
+// according to its class, if it has one.
+func serviceClassTimeout(service string) (time.Duration, bool) {
+	serviceClasses.RLock()
+	class, ok := serviceClasses.m[service]
+	serviceClasses.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	d, ok := serviceClassTimeouts[class]
+	return d, ok
+}
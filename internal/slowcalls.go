@@ -0,0 +1,83 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements a record of recent slow API calls, for debugging latency.
+
+import (
+	"sync"
+	"time"
+)
+
+// SlowCallSample describes an API call that took longer than the threshold
+// set with SetSlowCallSampling.
+type SlowCallSample struct {
+	CallID   string
+	Service  string
+	Method   string
+	Start    time.Time
+	Duration time.Duration
+	Err      error // the error returned by Call
+}
+
+var slowCalls = struct {
+	sync.Mutex
+	threshold time.Duration
+	ring      []SlowCallSample // len is the capacity of the buffer
+	next      int              // index of the next sample in ring
+	full      bool             // whether ring has wrapped
+}{
+	threshold: time.Second,
+	ring:      make([]SlowCallSample, 20),
+}
+
+// SetSlowCallSampling sets how long a call must take to be recorded as a
+// slow call, and how many of the most recent slow calls are kept.
+// The default is to keep 20 calls that took over a second.
+// A size of zero or less disables the recording.
+func SetSlowCallSampling(threshold time.Duration, size int) {
+	if size < 0 {
+		size = 0
+	}
+	slowCalls.Lock()
+	defer slowCalls.Unlock()
+	slowCalls.threshold = threshold
+	slowCalls.ring = make([]SlowCallSample, size)
+	slowCalls.next, slowCalls.full = 0, false
+}
+
+// recordSlowCall records a completed call if it was slow.
+func recordSlowCall(info *CallInfo, start time.Time) {
+	slowCalls.Lock()
+	defer slowCalls.Unlock()
+	if info.Duration <= slowCalls.threshold || len(slowCalls.ring) == 0 {
+		return
+	}
+	slowCalls.ring[slowCalls.next] = SlowCallSample{
+		CallID:   info.CallID,
+		Service:  info.Service,
+		Method:   info.Method,
+		Start:    start,
+		Duration: info.Duration,
+		Err:      info.Err,
+	}
+	slowCalls.next++
+	if slowCalls.next == len(slowCalls.ring) {
+		slowCalls.next, slowCalls.full = 0, true
+	}
+}
+
+// SlowCalls returns the most recent slow calls, oldest first.
+func SlowCalls() []SlowCallSample {
+	slowCalls.Lock()
+	defer slowCalls.Unlock()
+	if !slowCalls.full {
+		return append([]SlowCallSample(nil), slowCalls.ring[:slowCalls.next]...)
+	}
+	samples := append([]SlowCallSample(nil), slowCalls.ring[slowCalls.next:]...)
+	return append(samples, slowCalls.ring[:slowCalls.next]...)
+}
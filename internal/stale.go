@@ -0,0 +1,96 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements a record of the last good response of calls that
+// opt in to being answered with it when a later attempt fails.
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// maxStaleResponses bounds the number of responses kept for serving stale.
+const maxStaleResponses = 1000
+
+// maxStaleness is the age beyond which a response isn't served stale.
+var maxStaleness int64 = int64(5 * time.Minute) // atomic; a time.Duration
+
+// SetMaxStaleness sets the age beyond which a recorded response isn't served
+// in place of a failed call made with CallOptions.ServeStaleOnError. It is
+// 5 minutes by default; a d of zero or less stops stale responses being served.
+func SetMaxStaleness(d time.Duration) {
+	atomic.StoreInt64(&maxStaleness, int64(d))
+}
+
+type staleKey struct {
+	service, method, request string
+}
+
+type staleEntry struct {
+	response []byte
+	recorded time.Time
+}
+
+var staleCache = struct {
+	sync.Mutex
+	m map[staleKey]staleEntry
+}{m: make(map[staleKey]staleEntry)}
+
+// newStaleKey returns the key under which the response to a call is kept.
+func newStaleKey(service, method string, in proto.Message) (staleKey, error) {
+	data, err := marshalRequest(in, true)
+	if err != nil {
+		return staleKey{}, err
+	}
+	return staleKey{service, method, string(data)}, nil
+}
+
+// staleLookup returns the last good response recorded for a call, if it
+// is no older than SetMaxStaleness allows.
+func staleLookup(service, method string, in proto.Message) ([]byte, bool) {
+	k, err := newStaleKey(service, method, in)
+	if err != nil {
+		return nil, false
+	}
+	staleCache.Lock()
+	defer staleCache.Unlock()
+	e, ok := staleCache.m[k]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(e.recorded) > time.Duration(atomic.LoadInt64(&maxStaleness)) {
+		delete(staleCache.m, k)
+		return nil, false
+	}
+	return e.response, true
+}
+
+// staleRecord records the response of a successful call.
+func staleRecord(service, method string, in proto.Message, response []byte) {
+	k, err := newStaleKey(service, method, in)
+	if err != nil {
+		return
+	}
+	staleCache.Lock()
+	defer staleCache.Unlock()
+	if _, ok := staleCache.m[k]; !ok && len(staleCache.m) >= maxStaleResponses {
+		// Make room by forgetting the oldest response.
+		var oldest staleKey
+		var oldestTime time.Time
+		for k, e := range staleCache.m {
+			if oldestTime.IsZero() || e.recorded.Before(oldestTime) {
+				oldest, oldestTime = k, e.recorded
+			}
+		}
+		delete(staleCache.m, oldest)
+	}
+	staleCache.m[k] = staleEntry{response, time.Now()}
+}
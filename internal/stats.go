@@ -0,0 +1,162 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements process-wide counters of API calls.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatKey identifies a group of calls counted together by CallStats.
+type StatKey struct {
+	Service, Method string
+
+	// Tags holds the CallOptions.StatTags of the calls,
+	// as comma-separated key=value pairs sorted by key.
+	Tags string
+}
+
+// CallStat holds the counters of a group of calls.
+type CallStat struct {
+	Calls  int64
+	Errors int64
+	Time   time.Duration // total time taken by the calls
+
+	// ErrorCodes counts the calls that failed with a *CallError, by its code.
+	ErrorCodes map[int32]int64
+
+	// Latency counts the calls by how long they took. Latency[i] counts
+	// those that took no more than LatencyBounds[i], and longer than any
+	// smaller bound; the last element counts those that took longer still.
+	Latency []int64
+}
+
+// LatencyBounds are the upper bounds of the buckets of CallStat.Latency.
+var LatencyBounds = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	5 * time.Second,
+	60 * time.Second,
+}
+
+var callStats = struct {
+	sync.Mutex
+	m map[StatKey]*CallStat
+}{m: make(map[StatKey]*CallStat)}
+
+var maxStatKeys int32 = 1000 // atomic
+
+// SetMaxStatKeys sets the most groups of calls CallStats counts separately.
+// Once there are that many, calls with stat tags not already counted are
+// counted with the calls to the same method that have no tags.
+func SetMaxStatKeys(n int) {
+	atomic.StoreInt32(&maxStatKeys, int32(n))
+}
+
+var statsFlusher = struct {
+	sync.RWMutex
+	f func(map[StatKey]CallStat)
+}{}
+
+// SetStatsFlusher installs a function to which BeginDrain passes the
+// counters returned by CallStats once the calls in flight have finished,
+// such as to push them to a monitoring service before the instance shuts
+// down. A nil f, the default, leaves the counters unflushed.
+func SetStatsFlusher(f func(stats map[StatKey]CallStat)) {
+	statsFlusher.Lock()
+	statsFlusher.f = f
+	statsFlusher.Unlock()
+}
+
+// flushStats passes the counters to the function set by SetStatsFlusher.
+func flushStats() {
+	statsFlusher.RLock()
+	f := statsFlusher.f
+	statsFlusher.RUnlock()
+	if f != nil {
+		f(CallStats())
+	}
+}
+
+// lineBreakStripper removes line breaks from stat tags, which may come from
+// user input, so that they can't corrupt logs or metrics output.
+var lineBreakStripper = strings.NewReplacer("\r", "", "\n", "")
+
+// encodeStatTags returns tags in the form of StatKey.Tags.
+func encodeStatTags(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	kvs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		kvs = append(kvs, lineBreakStripper.Replace(k+"="+v))
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+// recordCallStats counts a completed call made with opts.
+func recordCallStats(info *CallInfo, opts *CallOptions) {
+	k := StatKey{Service: info.Service, Method: info.Method, Tags: encodeStatTags(opts.StatTags)}
+	callStats.Lock()
+	defer callStats.Unlock()
+	s := callStats.m[k]
+	if s == nil {
+		if k.Tags != "" && len(callStats.m) >= int(atomic.LoadInt32(&maxStatKeys)) {
+			k.Tags = ""
+			s = callStats.m[k]
+		}
+		if s == nil {
+			s = &CallStat{Latency: make([]int64, len(LatencyBounds)+1)}
+			callStats.m[k] = s
+		}
+	}
+	s.Calls++
+	s.Time += info.Duration
+	if info.Err != nil {
+		s.Errors++
+	}
+	if ce, ok := info.Err.(*CallError); ok {
+		if s.ErrorCodes == nil {
+			s.ErrorCodes = make(map[int32]int64)
+		}
+		s.ErrorCodes[ce.Code]++
+	}
+	i := sort.Search(len(LatencyBounds), func(i int) bool { return info.Duration <= LatencyBounds[i] })
+	s.Latency[i]++
+}
+
+// CallStats returns a snapshot of the counters of the API calls made by
+// this process, grouped by service, method and stat tags.
+func CallStats() map[StatKey]CallStat {
+	callStats.Lock()
+	defer callStats.Unlock()
+	m := make(map[StatKey]CallStat, len(callStats.m))
+	for k, s := range callStats.m {
+		cs := *s
+		cs.Latency = append([]int64(nil), s.Latency...)
+		if s.ErrorCodes != nil {
+			cs.ErrorCodes = make(map[int32]int64, len(s.ErrorCodes))
+			for code, n := range s.ErrorCodes {
+				cs.ErrorCodes[code] = n
+			}
+		}
+		m[k] = cs
+	}
+	return m
+}
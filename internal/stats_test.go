@@ -0,0 +1,175 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	netcontext "golang.org/x/net/context"
+
+	basepb "google.golang.org/appengine/internal/base"
+)
+
+func TestCallStatsTags(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	call := func(tags map[string]string) {
+		ctx := WithCallOptions(toContext(c), &CallOptions{StatTags: tags})
+		if err := Call(ctx, "echo", "Echo", &basepb.StringProto{Value: proto.String("hi")}, &basepb.StringProto{}); err != nil {
+			t.Fatalf("API call failed: %v", err)
+		}
+	}
+	call(map[string]string{"endpoint": "/home", "test": "tags"})
+	call(map[string]string{"endpoint": "/home", "test": "tags"})
+	call(map[string]string{"endpoint": "/about", "test": "tags"})
+
+	stats := CallStats()
+	for tags, want := range map[string]int64{
+		"endpoint=/home,test=tags":  2,
+		"endpoint=/about,test=tags": 1,
+	} {
+		k := StatKey{Service: "echo", Method: "Echo", Tags: tags}
+		if got := stats[k].Calls; got != want {
+			t.Errorf("CallStats()[%+v].Calls = %d, want %d", k, got, want)
+		}
+	}
+
+	// Beyond the limit, new tags aren't counted separately.
+	SetMaxStatKeys(len(stats))
+	defer SetMaxStatKeys(1000)
+	untagged := StatKey{Service: "echo", Method: "Echo"}
+	before := stats[untagged].Calls
+	call(map[string]string{"endpoint": "/contact", "test": "tags"})
+	stats = CallStats()
+	if _, ok := stats[StatKey{Service: "echo", Method: "Echo", Tags: "endpoint=/contact,test=tags"}]; ok {
+		t.Error("Call beyond the limit was counted with its tags")
+	}
+	if got, want := stats[untagged].Calls, before+1; got != want {
+		t.Errorf("Untagged calls = %d, want %d", got, want)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	ctx := WithCallOptions(toContext(c), &CallOptions{StatTags: map[string]string{"test": "metrics"}})
+	Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	Call(ctx, "errors", "OverQuota", &basepb.VoidProto{}, &basepb.VoidProto{})
+
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf); err != nil {
+		t.Fatalf("WriteMetrics: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE appengine_api_calls_total counter\n",
+		`appengine_api_calls_total{service="actordb",method="LookupActor",tags="test=metrics"} 1` + "\n",
+		`appengine_api_errors_total{service="errors",method="OverQuota",tags="test=metrics",code="4"} 1` + "\n",
+		`appengine_api_call_duration_seconds_bucket{service="actordb",method="LookupActor",tags="test=metrics",le="+Inf"} 1` + "\n",
+		`appengine_api_call_duration_seconds_count{service="actordb",method="LookupActor",tags="test=metrics"} 1` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Metrics don't contain %q; got:\n%s", want, out)
+		}
+	}
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	_, c, cleanup := setup()
+	defer cleanup()
+
+	ctx := WithCallOptions(toContext(c), &CallOptions{StatTags: map[string]string{"test": "diagnostics"}})
+	for i := 0; i < 3; i++ {
+		Call(ctx, "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+	}
+	Call(ctx, "errors", "OverQuota", &basepb.VoidProto{}, &basepb.VoidProto{})
+	before := currentDiagnostics().Counters["diagnostics_test"]
+	c.IncrCounter("diagnostics_test", 5)
+
+	rec := httptest.NewRecorder()
+	DiagnosticsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/_ah/diagnostics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var d diagnostics
+	if err := json.Unmarshal(rec.Body.Bytes(), &d); err != nil {
+		t.Fatalf("Bad JSON %q: %v", rec.Body, err)
+	}
+	want := map[string]callDiagnostics{
+		"actordb.LookupActor": {Calls: 3},
+		"errors.OverQuota":    {Calls: 1, Errors: 1},
+	}
+	for _, cd := range d.Calls {
+		if cd.Tags != "test=diagnostics" {
+			continue
+		}
+		name := cd.Service + "." + cd.Method
+		w, ok := want[name]
+		if !ok {
+			t.Errorf("Unexpected calls to %s", name)
+			continue
+		}
+		if cd.Calls != w.Calls || cd.Errors != w.Errors {
+			t.Errorf("%s: got %d calls and %d errors, want %d and %d", name, cd.Calls, cd.Errors, w.Calls, w.Errors)
+		}
+		delete(want, name)
+	}
+	for name := range want {
+		t.Errorf("Diagnostics have no calls to %s", name)
+	}
+	if d.Connections.Max != cap(limitSem) {
+		t.Errorf("Connections.Max = %d, want %d", d.Connections.Max, cap(limitSem))
+	}
+	if got, want := d.Counters["diagnostics_test"], before+5; got != want {
+		t.Errorf("Counters[diagnostics_test] = %d, want %d", got, want)
+	}
+}
+
+func TestSlowCalls(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	SetSlowCallSampling(40*time.Millisecond, 2)
+	defer SetSlowCallSampling(time.Second, 20)
+
+	f.hang = make(chan int) // only for RunSlowly
+	ctx, cancel := netcontext.WithTimeout(toContext(c), 100*time.Millisecond)
+	defer cancel()
+	err := Call(ctx, "errors", "RunSlowly", &basepb.VoidProto{}, &basepb.VoidProto{})
+	f.hang <- 1 // release the HTTP handler
+	if err == nil {
+		t.Fatal("RunSlowly call succeeded, want it to time out")
+	}
+	Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{})
+
+	samples := SlowCalls()
+	if len(samples) != 1 {
+		t.Fatalf("SlowCalls() = %+v, want just the RunSlowly call", samples)
+	}
+	if s := samples[0]; s.Service != "errors" || s.Method != "RunSlowly" || s.Duration < 40*time.Millisecond || s.Err != err {
+		t.Errorf("SlowCalls()[0] = %+v, want the RunSlowly call, taking at least 40ms and failing with %v", s, err)
+	}
+
+	// Only the most recent samples are kept.
+	for i := 0; i < 2; i++ {
+		if err := Call(toContext(c), "delay", "Respond", &basepb.VoidProto{}, &basepb.VoidProto{}); err != nil {
+			t.Fatalf("API call failed: %v", err)
+		}
+	}
+	samples = SlowCalls()
+	if len(samples) != 2 || samples[0].Service != "delay" || samples[1].Service != "delay" || !samples[0].Start.Before(samples[1].Start) {
+		t.Errorf("SlowCalls() = %+v, want the two delay calls, oldest first", samples)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements calls whose response message is copied to a writer
+// as it arrives, rather than being decoded.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	netcontext "golang.org/x/net/context"
+
+	remotepb "google.golang.org/appengine/internal/remote_api"
+)
+
+const (
+	// responseField is the field number of the response message
+	// in an encoded remote_api.Response.
+	responseField = 1
+
+	// maxEnvelopeField bounds the size of the other fields of a streamed
+	// remote_api.Response, which are kept in memory.
+	maxEnvelopeField = 1 << 20
+)
+
+// CallStream makes an API call like Call, but copies the encoded response
+// message to w as it arrives instead of decoding it, so that a large response
+// is never held in memory. The call must finish within c's deadline.
+// Of opts, which may be nil, those concerning the decoded response message
+// or the bookkeeping of Call are ignored.
+//
+// If the call fails after the response started arriving, w holds part of it.
+func (c *context) CallStream(service, method string, in proto.Message, w io.Writer, opts *CallOptions) error {
+	if opts == nil {
+		opts = noCallOptions
+	}
+	ctx := netcontext.Background()
+	atomic.AddInt32(&callsInFlight, 1)
+	defer endCall()
+	if err := c.admitCall(ctx, service, method); err != nil {
+		return err
+	}
+	if err := checkHeaderOptions(opts); err != nil {
+		return err
+	}
+	if err := c.waitRateLimit(ctx, service); err != nil {
+		return err
+	}
+	release, err := c.acquireCallSlot(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	timeout := c.callTimeout(time.Now(), ctx, service, method, opts)
+
+	data, err := marshalRequest(in, opts.Deterministic)
+	if err != nil {
+		return err
+	}
+	hreqBody, n, err := c.encodeCall(ctx, service, method, data, opts)
+	if err != nil {
+		return err
+	}
+
+	var info CallInfo
+	hrespBody, err := c.post(ctx, hreqBody, n, timeout, opts, &info, w)
+	if opts.NotModified != nil {
+		*opts.NotModified = err == errNotModified
+	}
+	if err == errNotModified {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res := &remotepb.Response{}
+	if err := proto.Unmarshal(hrespBody, res); err != nil {
+		return err
+	}
+	return responseError(service, res)
+}
+
+// responseTooLarge returns the error for a response message over limit bytes.
+func responseTooLarge(limit int64) error {
+	return &CallError{
+		Detail: fmt.Sprintf("response exceeds %d bytes", limit),
+		Code:   int32(remotepb.RpcError_RESPONSE_TOO_LARGE),
+	}
+}
+
+// streamWriteError is an error writing a streamed response message,
+// as distinct from an error reading it from the service bridge.
+type streamWriteError struct {
+	err error
+}
+
+func (e *streamWriteError) Error() string { return e.err.Error() }
+
+// streamResponse reads an encoded remote_api.Response from r, copying its
+// response message to w rather than keeping it. It returns the encoding of
+// the response's other fields, and the number of bytes read from r.
+// A response message over limit bytes, if limit is positive, is reported as
+// a *CallError, and a failure to write to w as a *streamWriteError.
+func streamResponse(r io.Reader, w io.Writer, limit int64) (rest []byte, read int, err error) {
+	cr := &countingReader{r: bufio.NewReader(r)}
+	sw := &recordingWriter{w: w}
+	var written int64
+	var buf [binary.MaxVarintLen64]byte
+	for {
+		key, err := binary.ReadUvarint(cr)
+		if err == io.EOF {
+			return rest, cr.n, nil
+		}
+		if err != nil {
+			return nil, cr.n, noEOF(err)
+		}
+		field, wire := key>>3, key&7
+		if wire != 0 && wire != 2 {
+			// remote_api.Response has only varint and length-delimited fields.
+			return nil, cr.n, fmt.Errorf("unexpected wire type %d for field %d", wire, field)
+		}
+		v, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return nil, cr.n, noEOF(err)
+		}
+		if wire == 2 && field == responseField {
+			written += int64(v)
+			if limit > 0 && written > limit {
+				return nil, cr.n, responseTooLarge(limit)
+			}
+			if _, err := io.CopyN(sw, cr, int64(v)); err != nil {
+				if sw.err != nil {
+					return nil, cr.n, &streamWriteError{sw.err}
+				}
+				return nil, cr.n, noEOF(err)
+			}
+			continue
+		}
+		rest = append(rest, buf[:binary.PutUvarint(buf[:], key)]...)
+		rest = append(rest, buf[:binary.PutUvarint(buf[:], v)]...)
+		if wire == 2 {
+			if v > maxEnvelopeField {
+				return nil, cr.n, fmt.Errorf("field %d is %d bytes", field, v)
+			}
+			start := len(rest)
+			rest = append(rest, make([]byte, v)...)
+			if _, err := io.ReadFull(cr, rest[start:]); err != nil {
+				return nil, cr.n, noEOF(err)
+			}
+		}
+	}
+}
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for reads that are
+// in the middle of a response.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r *bufio.Reader
+	n int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
+
+// recordingWriter writes to w, recording the error of a failed write.
+type recordingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	if err != nil {
+		rw.err = err
+	}
+	return n, err
+}
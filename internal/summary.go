@@ -0,0 +1,145 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+// This file implements an optional end-of-request summary of API calls.
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var requestSummary int32 // atomic; 1 if enabled
+
+// SetRequestSummary controls whether a summary of the API calls made while
+// serving each request, and of how long it took, is logged at the end of the
+// request. It is disabled by default.
+func SetRequestSummary(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&requestSummary, v)
+}
+
+var logRequests int32 // atomic; 1 if enabled
+
+// SetLogRequests controls whether the start of each request, with its method,
+// path and remote address, and its end, with its status and duration, are
+// logged at debug level. It is disabled by default.
+func SetLogRequests(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&logRequests, v)
+}
+
+// logRequestStart logs the start of c's request, if SetLogRequests enabled it.
+func (c *context) logRequestStart() {
+	if atomic.LoadInt32(&logRequests) == 0 {
+		return
+	}
+	logf(c, 0, "Request started: %s %s from %s", c.req.Method, c.req.URL.Path, c.req.RemoteAddr) // debug level
+}
+
+// logRequestEnd logs the end of c's request, which took d to serve,
+// if SetLogRequests enabled it.
+func (c *context) logRequestEnd(d time.Duration) {
+	if atomic.LoadInt32(&logRequests) == 0 {
+		return
+	}
+	status := c.outCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	logf(c, 0, "Request finished: status %d in %v", status, d) // debug level
+}
+
+// counterTotals holds the totals of the counters of all requests.
+var counterTotals struct {
+	sync.Mutex
+	m map[string]int64 // by name
+}
+
+// IncrCounter adds delta to the counter called name for c's request.
+// The counters of a request are included in its summary, and their totals
+// over all requests are reported by DiagnosticsHandler.
+func (c *context) IncrCounter(name string, delta int64) {
+	if c.parent != nil {
+		c = c.parent
+	}
+	c.counters.Lock()
+	if c.counters.m == nil {
+		c.counters.m = make(map[string]int64)
+	}
+	c.counters.m[name] += delta
+	c.counters.Unlock()
+
+	counterTotals.Lock()
+	if counterTotals.m == nil {
+		counterTotals.m = make(map[string]int64)
+	}
+	counterTotals.m[name] += delta
+	counterTotals.Unlock()
+}
+
+// counterSummary formats the counters of c's request for its summary,
+// in order of name.
+func (c *context) counterSummary() string {
+	c.counters.Lock()
+	defer c.counters.Unlock()
+	names := make([]string, 0, len(c.counters.m))
+	for name := range c.counters.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s=%d", name, c.counters.m[name])
+	}
+	return strings.Join(parts, " ")
+}
+
+// recordCall adds a completed call to the totals of the request.
+// Log flushes are left out, as the request didn't make them itself.
+func (c *context) recordCall(info *CallInfo) {
+	if isLogFlush(info.Service, info.Method) {
+		return
+	}
+	if c.parent != nil {
+		c = c.parent
+	}
+	c.callTotals.Lock()
+	c.callTotals.calls++
+	c.callTotals.elapsed += info.Duration
+	if info.Err != nil {
+		c.callTotals.errors++
+	}
+	c.callTotals.Unlock()
+}
+
+// logRequestSummary logs the summary enabled by SetRequestSummary,
+// if it is, for a request that took d to serve.
+func (c *context) logRequestSummary(d time.Duration) {
+	if atomic.LoadInt32(&requestSummary) == 0 {
+		return
+	}
+	c.callTotals.Lock()
+	calls, errors, elapsed := c.callTotals.calls, c.callTotals.errors, c.callTotals.elapsed
+	c.callTotals.Unlock()
+	if counters := c.counterSummary(); counters != "" {
+		logf(c, 1, "Request summary: %d API call(s) taking %v, %d failed; request took %v; counters: %s", calls, elapsed, errors, d, counters) // info level
+		return
+	}
+	logf(c, 1, "Request summary: %d API call(s) taking %v, %d failed; request took %v", calls, elapsed, errors, d) // info level
+}
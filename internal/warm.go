@@ -0,0 +1,79 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// warmTimeout bounds how long WarmAPIConnections waits for each connection.
+const warmTimeout = 5 * time.Second
+
+// WarmAPIConnections opens up to n connections to the API host and leaves
+// them idle in the connection pool, so that the first calls made by a new
+// instance don't pay for connection setup. It is meant to be called from a
+// warmup request handler. The transport keeps no more idle connections per
+// host than it is configured to; any more are closed. An n of zero or less
+// opens none.
+func WarmAPIConnections(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	u := apiURL()
+	if ru, ok, err := resolveAPIURL(); ok {
+		if err != nil {
+			return fmt.Errorf("warming API connections: resolving API host: %v", err)
+		}
+		u = ru
+	}
+	// The requests are made concurrently so that each needs a connection
+	// of its own. They are answered with an error, which doesn't matter.
+	target := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errc <- warmAPIConnection(target)
+		}()
+	}
+	var err error
+	for i := 0; i < n; i++ {
+		if e := <-errc; e != nil && err == nil {
+			err = fmt.Errorf("warming API connections: %v", e)
+		}
+	}
+	return err
+}
+
+// warmAPIConnection makes a request to u, and consumes the response so that
+// its connection is returned to the pool.
+func warmAPIConnection(u *url.URL) error {
+	hreq := &http.Request{
+		Method: "GET",
+		URL:    u,
+		Header: http.Header{},
+		Host:   u.Host,
+	}
+	client := apiClient(false)
+	tr := client.Transport.(*http.Transport)
+	t := time.AfterFunc(warmTimeout, func() {
+		tr.CancelRequest(hreq)
+	})
+	defer t.Stop()
+
+	hresp, err := client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+	_, err = io.Copy(ioutil.Discard, hresp.Body)
+	return err
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Google Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// +build !appengine
+
+package internal
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	basepb "google.golang.org/appengine/internal/base"
+)
+
+func TestWarmAPIConnections(t *testing.T) {
+	f, c, cleanup := setup()
+	defer cleanup()
+
+	var conns int32 // atomic
+	srv := httptest.NewUnstartedServer(f)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("SplitHostPort: %v", err)
+	}
+	SetAPIResolver(func() (string, string, error) {
+		return host, port, nil
+	})
+	defer SetAPIResolver(nil)
+
+	if err := WarmAPIConnections(2); err != nil {
+		t.Fatalf("WarmAPIConnections: %v", err)
+	}
+	warmed := atomic.LoadInt32(&conns)
+	if warmed == 0 {
+		t.Fatal("WarmAPIConnections opened no connections")
+	}
+
+	// A call after warming uses a warmed connection.
+	c.apiURL = &url.URL{Scheme: "http", Host: srv.Listener.Addr().String(), Path: apiPath}
+	if err := Call(toContext(c), "actordb", "LookupActor", &basepb.StringProto{Value: proto.String("Doctor Who")}, &basepb.StringProto{}); err != nil {
+		t.Fatalf("API call failed: %v", err)
+	}
+	if got := atomic.LoadInt32(&conns); got != warmed {
+		t.Errorf("API call after warming opened a connection: %d connections, want %d", got, warmed)
+	}
+
+	// Failing to find the API host is reported.
+	SetAPIResolver(func() (string, string, error) {
+		return "", "", errors.New("no API host configured")
+	})
+	if err := WarmAPIConnections(1); err == nil {
+		t.Error("WarmAPIConnections with no API host succeeded, want error")
+	}
+
+	// Warming no connections does nothing, not even finding the API host.
+	for _, n := range []int{0, -1} {
+		if err := WarmAPIConnections(n); err != nil {
+			t.Errorf("WarmAPIConnections(%d): %v", n, err)
+		}
+	}
+}